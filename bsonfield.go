@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// bsonFieldKind returns the field type used for a BSON value which InfluxDB
+// has no type for when the field has no field-types entry
+func bsonFieldKind(v interface{}) string {
+	switch vt := v.(type) {
+	case primitive.Decimal128:
+		return "float"
+	case time.Time, primitive.DateTime:
+		return "unix_ms"
+	case primitive.ObjectID, primitive.Binary, []byte:
+		return "hex"
+	case int8, int16, uint, uint8, uint16, uint32:
+		return "int"
+	case uint64:
+		if vt > math.MaxInt64 {
+			return "float"
+		}
+		return "int"
+	default:
+		return ""
+	}
+}
+
+func toUint(v interface{}) (uint64, error) {
+	switch vt := v.(type) {
+	case uint:
+		return uint64(vt), nil
+	case uint8:
+		return uint64(vt), nil
+	case uint16:
+		return uint64(vt), nil
+	case uint32:
+		return uint64(vt), nil
+	case uint64:
+		return vt, nil
+	case string:
+		return strconv.ParseUint(strings.TrimSpace(vt), 10, 64)
+	case primitive.Decimal128:
+		return strconv.ParseUint(vt.String(), 10, 64)
+	}
+	if i, ok := toInt(v); ok {
+		if i < 0 {
+			return 0, fmt.Errorf("value %v is negative", v)
+		}
+		return uint64(i), nil
+	}
+	if f, ok := toFloat(v); ok && f >= 0 && f == math.Trunc(f) && f < math.MaxUint64 {
+		return uint64(f), nil
+	}
+	return 0, fmt.Errorf("cannot convert %T value %v to unsigned", v, v)
+}
+
+func toInt(v interface{}) (int64, bool) {
+	switch vt := v.(type) {
+	case int:
+		return int64(vt), true
+	case int8:
+		return int64(vt), true
+	case int16:
+		return int64(vt), true
+	case int32:
+		return int64(vt), true
+	case int64:
+		return vt, true
+	case uint:
+		return int64(vt), uint64(vt) <= math.MaxInt64
+	case uint8:
+		return int64(vt), true
+	case uint16:
+		return int64(vt), true
+	case uint32:
+		return int64(vt), true
+	case uint64:
+		return int64(vt), vt <= math.MaxInt64
+	default:
+		return 0, false
+	}
+}
+
+func binaryBytes(v interface{}) ([]byte, bool) {
+	switch vt := v.(type) {
+	case primitive.Binary:
+		return vt.Data, true
+	case []byte:
+		return vt, true
+	case primitive.ObjectID:
+		return vt[:], true
+	default:
+		return nil, false
+	}
+}
+
+// coerceBSON handles the field types for unsigned integers, times and binary
+func coerceBSON(v interface{}, kind string) (interface{}, error) {
+	switch kind {
+	case "unsigned":
+		return toUint(v)
+	case "rfc3339":
+		if t, ok := toTime(v); ok {
+			return t.Format(time.RFC3339Nano), nil
+		}
+	case "unix", "unix_ms", "unix_us", "unix_ns":
+		if t, ok := toTime(v); ok {
+			return t.UnixNano() / int64(epochUnit(kind)), nil
+		}
+	case "hex":
+		if oid, ok := v.(primitive.ObjectID); ok {
+			return oid.Hex(), nil
+		}
+		if b, ok := binaryBytes(v); ok {
+			return hex.EncodeToString(b), nil
+		}
+	case "base64":
+		if b, ok := binaryBytes(v); ok {
+			return base64.StdEncoding.EncodeToString(b), nil
+		}
+	}
+	return nil, fmt.Errorf("cannot convert %T value %v to %s", v, v, kind)
+}
+
+func epochUnit(kind string) time.Duration {
+	switch kind {
+	case "unix":
+		return time.Second
+	case "unix_ms":
+		return time.Millisecond
+	case "unix_us":
+		return time.Microsecond
+	default:
+		return time.Nanosecond
+	}
+}
+
+func exactDecimal(s string) (*big.Float, bool) {
+	f, ok := new(big.Float).SetPrec(256).SetString(s)
+	return f, ok
+}
+
+// isLossy reports whether converting v to the field type kind as cv lost
+// precision
+func isLossy(v, cv interface{}, kind string) bool {
+	if t, ok := toTime(v); ok && strings.HasPrefix(kind, "unix") {
+		return t.UnixNano()%int64(epochUnit(kind)) != 0
+	}
+	f, ok := cv.(float64)
+	if !ok {
+		return false
+	}
+	converted := new(big.Float).SetPrec(256).SetFloat64(f)
+	if d, ok := v.(primitive.Decimal128); ok {
+		exact, ok := exactDecimal(d.String())
+		return ok && exact.Cmp(converted) != 0
+	}
+	if u, ok := v.(uint64); ok {
+		return new(big.Float).SetUint64(u).Cmp(converted) != 0
+	}
+	if i, ok := toInt(v); ok {
+		return new(big.Float).SetInt64(i).Cmp(converted) != 0
+	}
+	return false
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestCoerceBSON(t *testing.T) {
+	at := time.Date(2020, 9, 13, 12, 26, 40, 123456789, time.UTC)
+	oid := primitive.ObjectID{0x5d, 0xff}
+	bin := primitive.Binary{Subtype: 0, Data: []byte{0x01, 0xfe}}
+	tests := []struct {
+		v    interface{}
+		kind string
+		want interface{}
+	}{
+		{uint64(math.MaxUint64), "unsigned", uint64(math.MaxUint64)},
+		{uint32(9), "unsigned", uint64(9)},
+		{int64(9), "unsigned", uint64(9)},
+		{int32(-1), "unsigned", nil},
+		{" 18446744073709551615 ", "unsigned", uint64(math.MaxUint64)},
+		{"-1", "unsigned", nil},
+		{4.0, "unsigned", uint64(4)},
+		{4.5, "unsigned", nil},
+		{at, "rfc3339", "2020-09-13T12:26:40.123456789Z"},
+		{primitive.NewDateTimeFromTime(at), "rfc3339", "2020-09-13T12:26:40.123Z"},
+		{at, "unix", int64(1600000000)},
+		{at, "unix_ms", int64(1600000000123)},
+		{at, "unix_us", int64(1600000000123456)},
+		{at, "unix_ns", int64(1600000000123456789)},
+		{primitive.Timestamp{T: 1600000000}, "unix", int64(1600000000)},
+		{"2020-09-13", "unix", nil},
+		{oid, "hex", "5dff00000000000000000000"},
+		{bin, "hex", "01fe"},
+		{[]byte{0xab}, "hex", "ab"},
+		{bin, "base64", "Af4="},
+		{oid, "base64", "Xf8AAAAAAAAAAAAA"},
+		{"ab", "hex", nil},
+		{int64(1), "base64", nil},
+	}
+	for _, test := range tests {
+		got, err := coerceBSON(test.v, test.kind)
+		if test.want == nil {
+			if err == nil {
+				t.Errorf("coerceBSON(%T %v, %s) = %v, want an error", test.v, test.v, test.kind, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("coerceBSON(%T %v, %s): %s", test.v, test.v, test.kind, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("coerceBSON(%T %v, %s) = %T %v, want %T %v", test.v, test.v, test.kind, got, got, test.want, test.want)
+		}
+	}
+}
+
+func TestIsLossy(t *testing.T) {
+	exact, err := primitive.ParseDecimal128("12.5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	inexact, err := primitive.ParseDecimal128("0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wei, err := primitive.ParseDecimal128("123456789012345678901234567890")
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := time.Date(2020, 9, 13, 12, 26, 40, 123456789, time.UTC)
+	tests := []struct {
+		v     interface{}
+		kind  string
+		lossy bool
+	}{
+		{exact, "float", false},
+		{inexact, "float", true},
+		{wei, "float", true},
+		{int64(1 << 53), "float", false},
+		{int64(1<<53 + 1), "float", true},
+		{int64(-(1<<53 + 1)), "float", true},
+		{uint64(1 << 60), "float", false},
+		{uint64(math.MaxUint64), "float", true},
+		{uint64(1<<63 + 1), "float", true},
+		{int32(7), "float", false},
+		{at, "unix_ms", true},
+		{at, "unix_ns", false},
+		{at.Truncate(time.Second), "unix", false},
+		{primitive.NewDateTimeFromTime(at), "unix_ms", false},
+		{primitive.NewDateTimeFromTime(at), "unix", true},
+		{int64(1<<53 + 1), "int", false},
+		{"0.1", "string", false},
+	}
+	for _, test := range tests {
+		cv, err := coerceField(test.v, test.kind)
+		if err != nil {
+			t.Errorf("coerceField(%T %v, %s): %s", test.v, test.v, test.kind, err)
+			continue
+		}
+		if lossy := isLossy(test.v, cv, test.kind); lossy != test.lossy {
+			t.Errorf("isLossy(%T %v, %v, %s) = %t, want %t", test.v, test.v, cv, test.kind, lossy, test.lossy)
+		}
+	}
+}
+
+func TestBSONFieldKind(t *testing.T) {
+	tests := []struct {
+		v    interface{}
+		kind string
+	}{
+		{primitive.Decimal128{}, "float"},
+		{time.Time{}, "unix_ms"},
+		{primitive.DateTime(0), "unix_ms"},
+		{primitive.ObjectID{}, "hex"},
+		{[]byte{}, "hex"},
+		{uint16(1), "int"},
+		{uint64(math.MaxInt64), "int"},
+		{uint64(math.MaxInt64 + 1), "float"},
+		{int64(1), ""},
+		{"s", ""},
+	}
+	for _, test := range tests {
+		if kind := bsonFieldKind(test.v); kind != test.kind {
+			t.Errorf("bsonFieldKind(%T) = %q, want %q", test.v, kind, test.kind)
+		}
+	}
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/rwynn/gtm"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+type streamToken struct {
+	ts    primitive.Timestamp
+	token interface{}
+}
+
+// receivedTs is a new highest timestamp and when a worker received it
+type receivedTs struct {
+	ts primitive.Timestamp
+	at time.Time
+}
+
+// settleMargin is added to the gtm buffer duration to cover ops which gtm's
+// own fetch workers still hand over out of order
+const settleMargin = time.Second
+
+// checkpointer coordinates the resume position across all the workers. Each
+// oplog op holds a reference from the moment a worker receives it until the
+// points it produced are written, and only the low watermark below every
+// referenced op is saved. gtm delivers ops in any order so no single worker
+// can decide on its own how far it is safe to resume from. Older ops may also
+// still sit in gtm's buffer, so a timestamp only counts as seen once it was
+// received longer than the buffer duration ago. The position is only saved
+// with resume enabled but it also restarts gtm on a reload.
+type checkpointer struct {
+	sync.Mutex
+	config  *configOptions
+	client  *mongo.Client
+	pending map[primitive.Timestamp]int
+	seen    primitive.Timestamp
+	recent  []receivedTs
+	settled primitive.Timestamp
+	settle  time.Duration
+	now     func() time.Time
+	saved   primitive.Timestamp
+	tokens  map[string][]streamToken
+}
+
+func newCheckpointer(config *configOptions, client *mongo.Client) *checkpointer {
+	// the duration is validated when gtm is started
+	buffer, _ := time.ParseDuration(config.GtmSettings.BufferDuration)
+	return &checkpointer{
+		config:  config,
+		client:  client,
+		pending: make(map[primitive.Timestamp]int),
+		settle:  buffer + settleMargin,
+		now:     time.Now,
+		tokens:  make(map[string][]streamToken),
+	}
+}
+
+func tsLess(a, b primitive.Timestamp) bool {
+	return a.T < b.T || (a.T == b.T && a.I < b.I)
+}
+
+// tsBefore returns a timestamp which resumes at or before ts
+func tsBefore(ts primitive.Timestamp) primitive.Timestamp {
+	if ts.I > 1 {
+		return primitive.Timestamp{T: ts.T, I: ts.I - 1}
+	}
+	return primitive.Timestamp{T: ts.T - 1}
+}
+
+// track registers an op received by a worker and holds a reference to it
+func (cp *checkpointer) track(op *gtm.Op) {
+	if cp == nil || !op.IsSourceOplog() {
+		return
+	}
+	cp.Lock()
+	defer cp.Unlock()
+	cp.pending[op.Timestamp]++
+	cp.see(op.Timestamp)
+	if cp.config.Resume && cp.config.ResumeStrategy == tokenResumeStrategy && op.ResumeToken.StreamID != "" {
+		streamID := op.ResumeToken.StreamID
+		cp.tokens[streamID] = append(cp.tokens[streamID], streamToken{
+			ts:    op.Timestamp,
+			token: op.ResumeToken.ResumeToken,
+		})
+	}
+}
+
+// hold adds a reference to a tracked op, e.g. while its points are batched
+func (cp *checkpointer) hold(op *gtm.Op) {
+	if cp == nil || !op.IsSourceOplog() {
+		return
+	}
+	cp.Lock()
+	cp.pending[op.Timestamp]++
+	cp.Unlock()
+}
+
+// release drops a reference taken by track or hold
+func (cp *checkpointer) release(op *gtm.Op) {
+	if cp == nil || !op.IsSourceOplog() {
+		return
+	}
+	cp.Lock()
+	defer cp.Unlock()
+	if n := cp.pending[op.Timestamp]; n > 1 {
+		cp.pending[op.Timestamp] = n - 1
+	} else {
+		delete(cp.pending, op.Timestamp)
+	}
+}
+
+// releaseBatch releases the ops of a batch once its points are handled
+func (cp *checkpointer) releaseBatch(bp *Batch) {
+	seen := make(map[*gtm.Op]bool)
+	for _, op := range bp.ops {
+		if !seen[op] {
+			seen[op] = true
+			cp.release(op)
+		}
+	}
+}
+
+// advance moves the position forward to ts when nothing older is pending,
+// e.g. once direct reads have completed
+func (cp *checkpointer) advance(ts primitive.Timestamp) {
+	if cp == nil {
+		return
+	}
+	cp.Lock()
+	cp.see(ts)
+	cp.Unlock()
+}
+
+// untilSettled returns how long it takes until the highest timestamp seen so
+// far is settled
+func (cp *checkpointer) untilSettled() time.Duration {
+	if cp == nil {
+		return 0
+	}
+	cp.Lock()
+	defer cp.Unlock()
+	if len(cp.recent) == 0 {
+		return 0
+	}
+	last := cp.recent[len(cp.recent)-1]
+	if wait := last.at.Add(cp.settle).Sub(cp.now()); wait > 0 {
+		return wait
+	}
+	return 0
+}
+
+func (cp *checkpointer) see(ts primitive.Timestamp) {
+	if tsLess(cp.seen, ts) {
+		cp.seen = ts
+		cp.settleRecent()
+		cp.recent = append(cp.recent, receivedTs{ts: ts, at: cp.now()})
+	}
+}
+
+// settleRecent moves the timestamps received longer than the settle duration
+// ago into the settled position. Only the timestamps of the last settle
+// duration are kept, whether or not the position is ever saved.
+func (cp *checkpointer) settleRecent() {
+	settledAt := cp.now().Add(-cp.settle)
+	n := 0
+	for n < len(cp.recent) && !cp.recent[n].at.After(settledAt) {
+		cp.settled = cp.recent[n].ts
+		n++
+	}
+	if n > 0 {
+		cp.recent = append(cp.recent[:0], cp.recent[n:]...)
+	}
+}
+
+// watermark returns the position below every pending op and every op gtm may
+// still deliver
+func (cp *checkpointer) watermark() primitive.Timestamp {
+	cp.settleRecent()
+	wm := cp.settled
+	if len(cp.pending) == 0 {
+		return wm
+	}
+	var low primitive.Timestamp
+	first := true
+	for ts := range cp.pending {
+		if first || tsLess(ts, low) {
+			low, first = ts, false
+		}
+	}
+	if before := tsBefore(low); tsLess(before, wm) {
+		return before
+	}
+	return wm
+}
+
+// save persists the low watermark, or the resume tokens at or below it, if it
+// has moved since the last save
+func (cp *checkpointer) save() error {
+	if cp == nil || !cp.config.Resume {
+		return nil
+	}
+	cp.Lock()
+	wm := cp.watermark()
+	if wm.T == 0 || !tsLess(cp.saved, wm) {
+		cp.Unlock()
+		return nil
+	}
+	tokens := bson.M{}
+	for streamID, sts := range cp.tokens {
+		var latest *streamToken
+		for i := range sts {
+			if !tsLess(wm, sts[i].ts) && (latest == nil || tsLess(latest.ts, sts[i].ts)) {
+				latest = &sts[i]
+			}
+		}
+		if latest != nil {
+			tokens[streamID] = latest.token
+		}
+	}
+	cp.Unlock()
+	var err error
+	if cp.config.ResumeStrategy == tokenResumeStrategy {
+		err = saveTokens(cp.client, tokens, cp.config)
+	} else {
+		err = saveTimestamp(cp.client, wm, cp.config)
+	}
+	if err == nil {
+		cp.Lock()
+		cp.saved = wm
+		for streamID, sts := range cp.tokens {
+			var unsaved []streamToken
+			for _, st := range sts {
+				if tsLess(wm, st.ts) {
+					unsaved = append(unsaved, st)
+				}
+			}
+			cp.tokens[streamID] = unsaved
+		}
+		cp.Unlock()
+	}
+	return err
+}
+
+// restartAfter returns the start of a restarted gtm, after the ops which are
+// handled at the time of the call. Ops still held are read again. Until an op
+// has settled gtm restarts from started, the start of the stopped gtm.
+func (cp *checkpointer) restartAfter(started primitive.Timestamp) gtm.TimestampGenerator {
+	cp.Lock()
+	ts := cp.watermark()
+	cp.Unlock()
+	return func(client *mongo.Client, options *gtm.Options) (primitive.Timestamp, error) {
+		if ts.T == 0 {
+			if started.T == 0 {
+				return gtm.LastOpTimestamp(client, options)
+			}
+			infoLog.Printf("Restarting from timestamp %+v", started)
+			return started, nil
+		}
+		after := ts
+		after.I += 1
+		infoLog.Printf("Restarting from timestamp %+v", after)
+		return after, nil
+	}
+}
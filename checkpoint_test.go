@@ -0,0 +1,164 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/rwynn/gtm"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// testCheckpointer returns a checkpointer on a clock which only moves when
+// the test advances it
+func testCheckpointer() (*checkpointer, *time.Time) {
+	cp := newCheckpointer(&configOptions{
+		Resume:      true,
+		GtmSettings: GtmDefaultSettings(),
+	}, nil)
+	clock := time.Unix(1000, 0)
+	cp.now = func() time.Time {
+		return clock
+	}
+	return cp, &clock
+}
+
+func oplogOp(t, i uint32) *gtm.Op {
+	return &gtm.Op{
+		Timestamp: primitive.Timestamp{T: t, I: i},
+		Source:    gtm.OplogQuerySource,
+	}
+}
+
+func TestWatermarkStaysBelowPendingOps(t *testing.T) {
+	cp, clock := testCheckpointer()
+	older, newer := oplogOp(10, 1), oplogOp(12, 3)
+	// ops arrive out of order
+	cp.track(newer)
+	cp.track(older)
+	cp.release(newer)
+	*clock = clock.Add(time.Minute)
+	if wm := cp.watermark(); wm != (primitive.Timestamp{T: 9}) {
+		t.Errorf("expected the watermark before the pending op, got %+v", wm)
+	}
+	cp.release(older)
+	if wm := cp.watermark(); wm != newer.Timestamp {
+		t.Errorf("expected the watermark at the newest op, got %+v", wm)
+	}
+}
+
+func TestWatermarkHeldByBatchedOps(t *testing.T) {
+	cp, clock := testCheckpointer()
+	op := oplogOp(12, 3)
+	cp.track(op)
+	// two points of the op are batched
+	cp.hold(op)
+	cp.hold(op)
+	cp.release(op)
+	*clock = clock.Add(time.Minute)
+	if wm := cp.watermark(); wm != (primitive.Timestamp{T: 12, I: 2}) {
+		t.Errorf("expected the watermark before the batched op, got %+v", wm)
+	}
+	cp.releaseBatch(&Batch{ops: []*gtm.Op{op, op}})
+	if wm := cp.watermark(); wm != (primitive.Timestamp{T: 12, I: 2}) {
+		t.Errorf("expected a batch to release the op once, got %+v", wm)
+	}
+	cp.release(op)
+	if wm := cp.watermark(); wm != op.Timestamp {
+		t.Errorf("expected the watermark at the op, got %+v", wm)
+	}
+}
+
+func TestWatermarkWaitsForBufferedOps(t *testing.T) {
+	cp, clock := testCheckpointer()
+	first := oplogOp(10, 1)
+	cp.track(first)
+	cp.release(first)
+	*clock = clock.Add(time.Minute)
+	if wm := cp.watermark(); wm != first.Timestamp {
+		t.Fatalf("expected the watermark at the first op, got %+v", wm)
+	}
+	// an older op may still be in the gtm buffer right after a newer one
+	second := oplogOp(20, 1)
+	cp.track(second)
+	cp.release(second)
+	if wm := cp.watermark(); wm != first.Timestamp {
+		t.Errorf("expected the watermark held back at %+v, got %+v", first.Timestamp, wm)
+	}
+	*clock = clock.Add(cp.settle)
+	if wm := cp.watermark(); wm != second.Timestamp {
+		t.Errorf("expected the watermark at the second op once settled, got %+v", wm)
+	}
+}
+
+func TestWatermarkIgnoresDirectReads(t *testing.T) {
+	cp, clock := testCheckpointer()
+	direct := oplogOp(0, 0)
+	direct.Source = gtm.DirectQuerySource
+	cp.track(direct)
+	cp.advance(primitive.Timestamp{T: 30, I: 1})
+	*clock = clock.Add(time.Minute)
+	if wm := cp.watermark(); wm != (primitive.Timestamp{T: 30, I: 1}) {
+		t.Errorf("expected the watermark at the advanced position, got %+v", wm)
+	}
+}
+
+func TestSettledAfterDirectReads(t *testing.T) {
+	cp, clock := testCheckpointer()
+	ts := primitive.Timestamp{T: 30, I: 1}
+	cp.advance(ts)
+	if wm := cp.watermark(); wm.T != 0 {
+		t.Fatalf("expected no watermark before the position settled, got %+v", wm)
+	}
+	wait := cp.untilSettled()
+	if wait != cp.settle {
+		t.Errorf("expected to wait %s, got %s", cp.settle, wait)
+	}
+	*clock = clock.Add(wait)
+	if wm := cp.watermark(); wm != ts {
+		t.Errorf("expected the watermark at the advanced position, got %+v", wm)
+	}
+	if wait := cp.untilSettled(); wait != 0 {
+		t.Errorf("expected no wait once settled, got %s", wait)
+	}
+}
+
+func TestRecentBoundedWithoutResume(t *testing.T) {
+	cp, clock := testCheckpointer()
+	cp.config.Resume = false
+	step := 10 * time.Millisecond
+	for i := uint32(1); i <= 10000; i++ {
+		op := oplogOp(i, 1)
+		cp.track(op)
+		cp.release(op)
+		*clock = clock.Add(step)
+	}
+	if max := int(cp.settle/step) + 1; len(cp.recent) > max {
+		t.Errorf("expected at most %d recent timestamps, got %d", max, len(cp.recent))
+	}
+}
+
+func TestRestartBeforeSettled(t *testing.T) {
+	cp, _ := testCheckpointer()
+	op := oplogOp(40, 2)
+	cp.track(op)
+	cp.release(op)
+	started := primitive.Timestamp{T: 35, I: 1}
+	ts, err := cp.restartAfter(started)(nil, nil)
+	if err != nil || ts != started {
+		t.Errorf("expected a restart from %+v, got %+v (%v)", started, ts, err)
+	}
+}
+
+func TestTsBefore(t *testing.T) {
+	tests := []struct {
+		ts, want primitive.Timestamp
+	}{
+		{primitive.Timestamp{T: 10, I: 5}, primitive.Timestamp{T: 10, I: 4}},
+		{primitive.Timestamp{T: 10, I: 1}, primitive.Timestamp{T: 9}},
+	}
+	for _, test := range tests {
+		if got := tsBefore(test.ts); got != test.want || !tsLess(got, test.ts) {
+			t.Errorf("tsBefore(%+v) = %+v, want %+v", test.ts, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+)
+
+// computedValue is a tag or field computed from an expression
+type computedValue struct {
+	name string
+	src  string
+	expr expr
+}
+
+// parseComputed compiles a computed-fields or computed-tags table. The
+// values are computed in name order.
+func parseComputed(ns, kind string, table map[string]string) ([]*computedValue, error) {
+	var names []string
+	for name := range table {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var cvs []*computedValue
+	for _, name := range names {
+		e, err := parseExpr(table[name])
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s %s for namespace %s: %q: %s", kind, name, ns, table[name], err)
+		}
+		cvs = append(cvs, &computedValue{name: name, src: table[name], expr: e})
+	}
+	return cvs, nil
+}
+
+// env resolves expression names against the document and then against the
+// tags and fields already mapped, by output name
+func (m *InfluxDataMap) env(name string) (interface{}, bool) {
+	if v, found := lookupPath(m.op.Data, name); found {
+		return v, true
+	}
+	if v, found := m.fields[name]; found {
+		return v, true
+	}
+	v, found := m.tags[name]
+	return v, found
+}
+
+// loadComputed evaluates the computed tags and fields after loadData. Values
+// which fail to evaluate or are null are left out of the point.
+func (m *InfluxDataMap) loadComputed() {
+	for _, cv := range m.measure.computedTags {
+		if v := m.compute(cv, "tag"); v != nil {
+			m.loadTag(cv.name, cv.name, v)
+		}
+	}
+	for _, cv := range m.measure.computedFields {
+		if v := m.compute(cv, "field"); v != nil {
+			m.loadField(cv.name, cv.name, v)
+		}
+	}
+}
+
+func (m *InfluxDataMap) compute(cv *computedValue, kind string) interface{} {
+	v, err := cv.expr.eval(m.env)
+	if err != nil {
+		errorLog.Printf("Unable to compute %s %s in namespace %s: %s\n", kind, cv.name, m.op.Namespace, err)
+		return nil
+	}
+	return v
+}
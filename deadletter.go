@@ -0,0 +1,325 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/rwynn/gtm"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	deadLetterCollection = "deadletter"
+	stageMap             = "map"
+	stageWrite           = "write"
+)
+
+// allMeasures marks a dead letter which is replayed with every measurement of
+// its namespace
+const allMeasures = "*"
+
+// measureError is the failure of an op in some of the measurements of its
+// namespace, named by their keys
+type measureError struct {
+	keys []string
+	err  error
+}
+
+func (e *measureError) Error() string {
+	return fmt.Sprintf("%s (measurement %s)", e.err, strings.Join(e.keys, ", "))
+}
+
+// failedMeasures returns the keys of the measurements which failed with err
+func failedMeasures(err error) []string {
+	if me, ok := err.(*measureError); ok {
+		return me.keys
+	}
+	return []string{allMeasures}
+}
+
+type deadLetterEntry struct {
+	ID        primitive.ObjectID     `bson:"_id"`
+	Namespace string                 `bson:"ns"`
+	DocID     interface{}            `bson:"id"`
+	Ts        primitive.Timestamp    `bson:"ts"`
+	Operation string                 `bson:"operation"`
+	Source    string                 `bson:"source"`
+	Doc       map[string]interface{} `bson:"doc"`
+	Error     string                 `bson:"error"`
+	Stage     string                 `bson:"stage"`
+	Measures  []string               `bson:"measures"`
+	Attempts  int                    `bson:"attempts"`
+	CreatedAt time.Time              `bson:"createdAt"`
+	UpdatedAt time.Time              `bson:"updatedAt"`
+}
+
+// sourceName names where op was read from, as seen by templates, plugins and
+// dead letters: "direct", "changestream" or "oplog"
+func sourceName(op *gtm.Op) string {
+	if op.IsSourceDirect() {
+		return "direct"
+	}
+	if op.ResumeToken.StreamID != "" {
+		return "changestream"
+	}
+	return "oplog"
+}
+
+func deadLetters(client *mongo.Client) *mongo.Collection {
+	return client.Database(Name).Collection(deadLetterCollection)
+}
+
+// deadLetter saves the op so that it can be replayed later. Repeated failures
+// of the same document update a single entry and increment its attempts. The
+// entry collects the measurements which failed so that a replay does not
+// write the points of the others again.
+func (ctx *InfluxCtx) deadLetter(op *gtm.Op, stage string, cause error) error {
+	now := time.Now().UTC()
+	opts := options.Update()
+	opts.SetUpsert(true)
+	_, err := deadLetters(ctx.client).UpdateOne(context.Background(), bson.M{
+		"ns": op.Namespace,
+		"id": op.Id,
+	}, bson.M{
+		"$set": bson.M{
+			"ts":        op.Timestamp,
+			"operation": op.Operation,
+			"source":    sourceName(op),
+			"doc":       op.Data,
+			"error":     cause.Error(),
+			"stage":     stage,
+			"updatedAt": now,
+		},
+		"$addToSet":    bson.M{"measures": bson.M{"$each": failedMeasures(cause)}},
+		"$inc":         bson.M{"attempts": 1},
+		"$setOnInsert": bson.M{"createdAt": now},
+	}, opts)
+	return err
+}
+
+// fail records an op which could not be mapped or written
+func (ctx *InfluxCtx) fail(op *gtm.Op, stage string, cause error) {
+	atomic.AddInt64(&counters.failed, 1)
+	exitStatus = 1
+	errorLog.Println(cause)
+	if ctx.config.DeadLetter {
+		if err := ctx.deadLetter(op, stage, cause); err != nil {
+			errorLog.Printf("Unable to dead letter document %v of namespace %s: %s\n", op.Id, op.Namespace, err)
+		} else {
+			atomic.AddInt64(&counters.deadLettered, 1)
+		}
+	}
+}
+
+// normalizeDoc converts the bson container types of a decoded document into
+// the plain maps and slices produced by gtm
+func normalizeDoc(v interface{}) interface{} {
+	switch vt := v.(type) {
+	case primitive.D:
+		m := make(map[string]interface{}, len(vt))
+		for _, e := range vt {
+			m[e.Key] = normalizeDoc(e.Value)
+		}
+		return m
+	case primitive.M:
+		return normalizeDoc(map[string]interface{}(vt))
+	case map[string]interface{}:
+		for k, child := range vt {
+			vt[k] = normalizeDoc(child)
+		}
+		return vt
+	case primitive.A:
+		return normalizeDoc([]interface{}(vt))
+	case []interface{}:
+		for i, child := range vt {
+			vt[i] = normalizeDoc(child)
+		}
+		return vt
+	default:
+		return v
+	}
+}
+
+func (e *deadLetterEntry) op() *gtm.Op {
+	op := &gtm.Op{
+		Id:        e.DocID,
+		Namespace: e.Namespace,
+		Operation: e.Operation,
+		Timestamp: e.Ts,
+		Source:    gtm.OplogQuerySource,
+	}
+	if e.Source == "direct" {
+		op.Source = gtm.DirectQuerySource
+	}
+	op.Data, _ = normalizeDoc(e.Doc).(map[string]interface{})
+	return op
+}
+
+// replayMeasures returns the measurements to replay the entry with. Entries
+// without measurement keys predate them and are replayed with all of them.
+func (e *deadLetterEntry) replayMeasures(ctx *InfluxCtx) []*InfluxMeasure {
+	all := ctx.measuresFor(e.Namespace)
+	keys := make(map[string]bool)
+	for _, key := range e.Measures {
+		if key == allMeasures {
+			return all
+		}
+		keys[key] = true
+	}
+	if len(keys) == 0 {
+		return all
+	}
+	var measures []*InfluxMeasure
+	for _, im := range all {
+		if keys[im.key] {
+			measures = append(measures, im)
+		}
+	}
+	return measures
+}
+
+func deadLetterQuery(args []string) bson.M {
+	query := bson.M{}
+	if len(args) > 0 {
+		query["ns"] = args[0]
+	}
+	return query
+}
+
+func listDeadLetters(client *mongo.Client, args []string) error {
+	cursor, err := deadLetters(client).Find(context.Background(), deadLetterQuery(args),
+		options.Find().SetSort(bson.M{"createdAt": 1}))
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(context.Background())
+	count := 0
+	for cursor.Next(context.Background()) {
+		var e deadLetterEntry
+		if err = cursor.Decode(&e); err != nil {
+			return err
+		}
+		count++
+		fmt.Printf("%s\t%s\t%v\tstage=%s\tmeasures=%s\tattempts=%d\tupdated=%s\t%s\n",
+			e.ID.Hex(), e.Namespace, e.DocID, e.Stage, strings.Join(e.Measures, ","), e.Attempts,
+			e.UpdatedAt.Format(time.RFC3339), e.Error)
+	}
+	if err = cursor.Err(); err != nil {
+		return err
+	}
+	fmt.Printf("%d dead letters\n", count)
+	return nil
+}
+
+func purgeDeadLetters(client *mongo.Client, args []string) error {
+	result, err := deadLetters(client).DeleteMany(context.Background(), deadLetterQuery(args))
+	if err != nil {
+		return err
+	}
+	infoLog.Printf("%d dead letters purged\n", result.DeletedCount)
+	return nil
+}
+
+// replayDeadLetters runs each dead letter through the current measurements
+// which failed and the sink. Entries are removed once written; failures update the entry.
+func replayDeadLetters(config *configOptions, client *mongo.Client, args []string) error {
+	sink, err := config.NewSink()
+	if err != nil {
+		return err
+	}
+	defer sink.Close()
+	ctx, err := newInfluxCtx(config, sink, client, nil)
+	if err != nil {
+		return err
+	}
+	if err = ctx.applyTargets(); err != nil {
+		return err
+	}
+	ctx.config.DeadLetter = true
+	cursor, err := deadLetters(client).Find(context.Background(), deadLetterQuery(args),
+		options.Find().SetSort(bson.M{"createdAt": 1}))
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(context.Background())
+	var entries []*deadLetterEntry
+	for cursor.Next(context.Background()) {
+		e := &deadLetterEntry{}
+		if err = cursor.Decode(e); err != nil {
+			return err
+		}
+		measures := e.replayMeasures(ctx)
+		if len(measures) == 0 {
+			// kept until the measurements are configured again or purged
+			exitStatus = 1
+			errorLog.Printf("Measurements %s of dead letter %s are no longer configured\n",
+				strings.Join(e.Measures, ", "), e.ID.Hex())
+			continue
+		}
+		entries = append(entries, e)
+		if err := ctx.addPointTo(e.op(), measures); err != nil {
+			ctx.fail(e.op(), stageMap, err)
+		}
+	}
+	if err = cursor.Err(); err != nil {
+		return err
+	}
+	// partial updates are queued for lookup like in the worker loop
+	ctx.flushLookups()
+	if err = ctx.writeBatch(); err != nil {
+		errorLog.Println(err)
+	}
+	replayed := 0
+	for _, e := range entries {
+		// entries which failed again were updated and no longer match
+		result, err := deadLetters(client).DeleteOne(context.Background(), bson.M{
+			"_id":       e.ID,
+			"updatedAt": e.UpdatedAt,
+		})
+		if err != nil {
+			return err
+		}
+		replayed += int(result.DeletedCount)
+	}
+	infoLog.Printf("%d of %d dead letters replayed\n", replayed, len(entries))
+	return nil
+}
+
+func runDeadLetterCommand(config *configOptions, client *mongo.Client, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: %s deadletter list|replay|purge [namespace]", Name)
+	}
+	switch args[0] {
+	case "list":
+		return listDeadLetters(client, args[1:])
+	case "replay":
+		return replayDeadLetters(config, client, args[1:])
+	case "purge":
+		return purgeDeadLetters(client, args[1:])
+	default:
+		return fmt.Errorf("unknown deadletter command %q, expected list, replay or purge", args[0])
+	}
+}
+
+func runCommand(config *configOptions, client *mongo.Client, args []string) {
+	var err error
+	switch args[0] {
+	case "deadletter":
+		err = runDeadLetterCommand(config, client, args[1:])
+	default:
+		err = fmt.Errorf("unknown command %q", args[0])
+	}
+	closePlugins(config.Measurement)
+	client.Disconnect(context.Background())
+	if err != nil {
+		errorLog.Fatalln(err)
+	}
+	os.Exit(exitStatus)
+}
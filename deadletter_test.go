@@ -0,0 +1,44 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestReplayMeasures(t *testing.T) {
+	raw := &InfluxMeasure{key: "tomodex.trades|raw|"}
+	volume := &InfluxMeasure{key: "tomodex.trades|volume|"}
+	ctx := &InfluxCtx{
+		measures: map[string][]*InfluxMeasure{"tomodex.trades": {raw, volume}},
+	}
+	tests := []struct {
+		measures []string
+		want     []*InfluxMeasure
+	}{
+		{nil, []*InfluxMeasure{raw, volume}},
+		{[]string{allMeasures}, []*InfluxMeasure{raw, volume}},
+		{[]string{volume.key}, []*InfluxMeasure{volume}},
+		{[]string{volume.key, allMeasures}, []*InfluxMeasure{raw, volume}},
+		{[]string{"tomodex.trades|gone|"}, nil},
+	}
+	for _, test := range tests {
+		e := &deadLetterEntry{Namespace: "tomodex.trades", Measures: test.measures}
+		if got := e.replayMeasures(ctx); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("replayMeasures(%v) = %v, want %v", test.measures, got, test.want)
+		}
+	}
+}
+
+func TestFailedMeasures(t *testing.T) {
+	if got := failedMeasures(errors.New("lookup failed")); !reflect.DeepEqual(got, []string{allMeasures}) {
+		t.Errorf("expected every measurement for a plain error, got %v", got)
+	}
+	err := &measureError{keys: []string{"a", "b"}, err: errors.New("bad")}
+	if got := failedMeasures(err); !reflect.DeepEqual(got, []string{"a", "b"}) {
+		t.Errorf("expected the failed measurements, got %v", got)
+	}
+	if want := "bad (measurement a, b)"; err.Error() != want {
+		t.Errorf("expected %q, got %q", want, err.Error())
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	client "github.com/influxdata/influxdb1-client/v2"
+	"github.com/rwynn/gtm"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	onDeleteIgnore        = "ignore"
+	onDeleteTombstone     = "tombstone"
+	onDeleteDelete        = "delete"
+	tombstoneFieldDefault = "deleted"
+	pointsCollection      = "points"
+)
+
+// pointRef identifies a point written for a document so that it can be
+// found again once the document is deleted
+type pointRef struct {
+	Database        string            `bson:"db"`
+	RetentionPolicy string            `bson:"rp"`
+	Name            string            `bson:"name"`
+	Tags            map[string]string `bson:"tags"`
+	Time            time.Time         `bson:"time"`
+}
+
+// pointDeleter is implemented by sinks which can delete written points
+type pointDeleter interface {
+	DeletePoint(ref *pointRef) error
+}
+
+func precisionDuration(precision string) time.Duration {
+	switch precision {
+	case "us", "u":
+		return time.Microsecond
+	case "ms":
+		return time.Millisecond
+	case "s":
+		return time.Second
+	case "m":
+		return time.Minute
+	case "h":
+		return time.Hour
+	default:
+		return time.Nanosecond
+	}
+}
+
+func newPointRefs(measure *InfluxMeasure, points []*client.Point) []*pointRef {
+	var refs []*pointRef
+	for _, pt := range points {
+		refs = append(refs, &pointRef{
+			Database:        measure.database,
+			RetentionPolicy: measure.retention,
+			Name:            pt.Name(),
+			Tags:            pt.Tags(),
+			// InfluxDB stores the time truncated to the write precision
+			Time: pt.Time().Truncate(precisionDuration(measure.precision)).UTC(),
+		})
+	}
+	return refs
+}
+
+func pointsIndex(client *mongo.Client) *mongo.Collection {
+	return client.Database(Name).Collection(pointsCollection)
+}
+
+// key identifies the measurement among the measurements of its namespace
+// when points are remembered. It only depends on settings so that it stays
+// the same when blocks are added or reordered, unless id is set.
+func (ms *measureSettings) key() string {
+	if ms.ID != "" {
+		return ms.ID
+	}
+	return fmt.Sprintf("%s|%s|%s", ms.name(), ms.Database, ms.Measure)
+}
+
+// pointsFilter selects the points remembered for a document by one of the
+// measurements of its namespace
+func pointsFilter(op *gtm.Op, measure *InfluxMeasure) bson.M {
+	return bson.M{"ns": op.Namespace, "id": op.Id, "measure": measure.key}
+}
+
+// remember adds the points of a document to the batch holding them. They are
+// saved once the batch is written and are needed to map a later delete which
+// carries no document.
+func (bp *Batch) remember(op *gtm.Op, measure *InfluxMeasure, points []*client.Point) {
+	model := mongo.NewReplaceOneModel()
+	model.SetUpsert(true)
+	model.SetFilter(pointsFilter(op, measure))
+	model.SetReplacement(bson.M{
+		"ns":      op.Namespace,
+		"id":      op.Id,
+		"measure": measure.key,
+		"points":  newPointRefs(measure, points),
+	})
+	bp.remembered = append(bp.remembered, model)
+}
+
+// saveRemembered saves the points of the documents of a written batch
+func (ctx *InfluxCtx) saveRemembered(bp *Batch) error {
+	if len(bp.remembered) == 0 {
+		return nil
+	}
+	_, err := pointsIndex(ctx.client).BulkWrite(context.Background(), bp.remembered,
+		options.BulkWrite().SetOrdered(true))
+	bp.remembered = nil
+	return err
+}
+
+// deletedPoints finds the points written for a deleted document, either by
+// mapping the pre-image carried by the op or from the remembered points. A
+// pre-image which the measurement would not have mapped produced no points.
+func (ctx *InfluxCtx) deletedPoints(op *gtm.Op, measure *InfluxMeasure) ([]*pointRef, error) {
+	if len(op.Data) > 1 {
+		pre := measure.withDefaults(op)
+		if measure.accepts(pre.Data) && len(measure.missingFields(pre.Data)) == 0 {
+			if points, err := ctx.mapPoints(pre, measure); err == nil {
+				return newPointRefs(measure, points), nil
+			}
+		}
+	}
+	// the batches of this worker hold the points of the earlier ops on the
+	// document which are not remembered yet
+	if err := ctx.writeBatch(); err != nil {
+		return nil, err
+	}
+	var doc struct {
+		Points []*pointRef `bson:"points"`
+	}
+	result := pointsIndex(ctx.client).FindOne(context.Background(), pointsFilter(op, measure))
+	if err := result.Err(); err == mongo.ErrNoDocuments {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := result.Decode(&doc); err != nil {
+		return nil, err
+	}
+	return doc.Points, nil
+}
+
+// deletePoints applies the on-delete policy of the measurement to a delete
+func (ctx *InfluxCtx) deletePoints(op *gtm.Op, measure *InfluxMeasure) error {
+	if measure.onDelete == onDeleteIgnore {
+		return nil
+	}
+	refs, err := ctx.deletedPoints(op, measure)
+	if err != nil {
+		return err
+	}
+	if len(refs) == 0 {
+		if ctx.config.Verbose {
+			infoLog.Printf("No points found for deleted document %v in namespace %s\n", op.Id, op.Namespace)
+		}
+		return nil
+	}
+	switch measure.onDelete {
+	case onDeleteTombstone:
+		bp, err := ctx.setupDatabase(measure)
+		if err != nil {
+			return err
+		}
+		for _, ref := range refs {
+			pt, err := client.NewPoint(ref.Name, ref.Tags, map[string]interface{}{
+				measure.tombstone: true,
+			}, ref.Time)
+			if err != nil {
+				return err
+			}
+			ctx.batchPoint(bp, pt, op)
+		}
+	case onDeleteDelete:
+		// points still batched would otherwise be written after the delete
+		if err := ctx.writeBatch(); err != nil {
+			return err
+		}
+		deleter := ctx.sink.(pointDeleter)
+		for _, ref := range refs {
+			if _, err := ctx.retry.retry(func() error {
+				return deleter.DeletePoint(ref)
+			}, nil); err != nil {
+				return err
+			}
+		}
+	}
+	_, err = pointsIndex(ctx.client).DeleteOne(context.Background(), pointsFilter(op, measure))
+	return err
+}
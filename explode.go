@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	explodeIndexDefault = "index"
+	explodeIndexNone    = "-"
+)
+
+// explodeDocs returns the documents to map for a document. With explode set
+// there is one per element of the array, each a copy of the parent document
+// with the array replaced by the element. Element keys are then addressed as
+// e.g. matches.price and the parent tags and fields are inherited.
+func (im *InfluxMeasure) explodeDocs(doc map[string]interface{}) ([]map[string]interface{}, error) {
+	if im.explode == "" {
+		return []map[string]interface{}{doc}, nil
+	}
+	v, found := lookupPath(doc, im.explode)
+	if !found || v == nil {
+		return nil, nil
+	}
+	var elems []interface{}
+	switch vt := v.(type) {
+	case []interface{}:
+		elems = vt
+	case primitive.A:
+		elems = vt
+	default:
+		return nil, fmt.Errorf("explode field %s had type %T, but expected an array", im.explode, v)
+	}
+	docs := make([]map[string]interface{}, 0, len(elems))
+	for _, elem := range elems {
+		data := make(map[string]interface{}, len(doc))
+		for k, dv := range doc {
+			data[k] = dv
+		}
+		setPath(data, im.explode, elem)
+		docs = append(docs, data)
+	}
+	return docs, nil
+}
+
+// loadElementIndex tags the point with the position of its element. The
+// elements share the parent tags and, without their own time, the parent
+// time too, so they would otherwise overwrite each other as one point.
+func (m *InfluxDataMap) loadElementIndex(i int) {
+	if m.measure.explode != "" && m.measure.explodeIndex != "" {
+		m.tags[m.measure.explodeIndex] = strconv.Itoa(i)
+	}
+}
+
+// toTime converts the BSON time types to a UTC time
+func toTime(v interface{}) (time.Time, bool) {
+	switch vt := v.(type) {
+	case time.Time:
+		return vt.UTC(), true
+	case primitive.Timestamp:
+		return TimestampTime(vt), true
+	case primitive.DateTime:
+		return time.Unix(0, int64(vt)*int64(time.Millisecond)).UTC(), true
+	default:
+		return time.Time{}, false
+	}
+}
+
+// loadElementTime sets the point time from the explode-timefield of the
+// element. The parent time is kept when the element has no such key.
+func (m *InfluxDataMap) loadElementTime() error {
+	if m.measure.explode == "" || m.measure.explodeTime == "" {
+		return nil
+	}
+	path := m.measure.explode + "." + m.measure.explodeTime
+	v, found := lookupPath(m.op.Data, path)
+	if !found {
+		return nil
+	}
+	t, err := m.measure.pointTime(v)
+	if err != nil {
+		return fmt.Errorf("time field %s %s", path, err)
+	}
+	m.t = t
+	m.timefield = true
+	return nil
+}
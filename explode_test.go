@@ -0,0 +1,89 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/rwynn/gtm"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestExplodeDocs(t *testing.T) {
+	parent := time.Date(2020, 9, 13, 12, 0, 0, 0, time.UTC)
+	matched := parent.Add(time.Minute)
+	doc := map[string]interface{}{
+		"_id":       primitive.ObjectID{0x5d},
+		"pair":      "TOMO/USDT",
+		"createdAt": parent,
+		"matches": []interface{}{
+			map[string]interface{}{"price": 1.5, "createdAt": matched},
+			map[string]interface{}{"price": 2.5},
+		},
+	}
+	tests := []struct {
+		index string
+		tag   string
+	}{
+		{"", "index"},
+		{"match", "match"},
+		{"-", ""},
+	}
+	for _, test := range tests {
+		ctx := &InfluxCtx{
+			config: &configOptions{Measurement: []*measureSettings{{
+				Namespace:    "tomodex.trades",
+				Tags:         []string{"pair"},
+				Fields:       []string{"matches.price"},
+				Timefield:    "createdAt",
+				Explode:      "matches",
+				ExplodeTime:  "createdAt",
+				ExplodeIndex: test.index,
+			}}},
+			measures: make(map[string][]*InfluxMeasure),
+			matched:  make(map[string][]*InfluxMeasure),
+		}
+		if err := ctx.setupMeasurements(); err != nil {
+			t.Fatal(err)
+		}
+		op := &gtm.Op{Id: doc["_id"], Namespace: "tomodex.trades", Operation: "i", Data: doc}
+		points, err := ctx.mapPoints(op, ctx.measures["tomodex.trades"][0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(points) != 2 {
+			t.Fatalf("explode-index-tag %q: expected a point per element, got %d", test.index, len(points))
+		}
+		for i, pt := range points {
+			tags := pt.Tags()
+			if tags["pair"] != "TOMO/USDT" {
+				t.Errorf("explode-index-tag %q: expected point %d to inherit the pair tag, got %v", test.index, i, tags)
+			}
+			if test.tag == "" {
+				if len(tags) != 1 {
+					t.Errorf("explode-index-tag %q: expected point %d to have no index tag, got %v", test.index, i, tags)
+				}
+			} else if want := []string{"0", "1"}[i]; tags[test.tag] != want {
+				t.Errorf("explode-index-tag %q: expected point %d to be tagged %s=%s, got %v", test.index, i, test.tag, want, tags)
+			}
+		}
+		if fields, _ := points[0].Fields(); fields["matches.price"] != 1.5 {
+			t.Errorf("expected the first point to hold the price of its element, got %v", fields)
+		}
+		if !points[0].Time().Equal(matched) {
+			t.Errorf("expected the first point to take the time of its element, got %s", points[0].Time())
+		}
+		if !points[1].Time().Equal(parent) {
+			t.Errorf("expected the second point to take the parent time, got %s", points[1].Time())
+		}
+	}
+}
+
+func TestExplodeDocsNotArray(t *testing.T) {
+	im := &InfluxMeasure{explode: "matches"}
+	if docs, err := im.explodeDocs(map[string]interface{}{"matches": "none"}); err == nil {
+		t.Errorf("expected an error for an explode field which is not an array, got %v", docs)
+	}
+	if docs, err := im.explodeDocs(map[string]interface{}{}); err != nil || len(docs) != 0 {
+		t.Errorf("expected no documents without the explode field, got %v, %v", docs, err)
+	}
+}
@@ -0,0 +1,701 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/big"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// expr is a compiled computed-fields or computed-tags expression. The
+// language has numbers, strings, true, false and null, document paths such
+// as price or legs[0].qty, the operators + - * / % == != < <= > >= && || !
+// and ?: and the functions in exprFuncs. Integer arithmetic which overflows
+// int64 is computed as a float.
+type expr interface {
+	eval(env exprEnv) (interface{}, error)
+}
+
+// exprEnv resolves the names used in an expression
+type exprEnv func(name string) (interface{}, bool)
+
+type exprToken struct {
+	kind string // num, str, ident or op
+	text string
+	pos  int
+}
+
+func lexExpr(src string) ([]exprToken, error) {
+	var tokens []exprToken
+	rs := []rune(src)
+	for i := 0; i < len(rs); {
+		r := rs[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case unicode.IsDigit(r) || (r == '.' && i+1 < len(rs) && unicode.IsDigit(rs[i+1])):
+			start := i
+			for i < len(rs) && (unicode.IsDigit(rs[i]) || rs[i] == '.' || rs[i] == 'e' || rs[i] == 'E' ||
+				((rs[i] == '-' || rs[i] == '+') && (rs[i-1] == 'e' || rs[i-1] == 'E'))) {
+				i++
+			}
+			tokens = append(tokens, exprToken{"num", string(rs[start:i]), start})
+		case r == '"' || r == '\'':
+			start := i
+			var sb strings.Builder
+			for i++; i < len(rs) && rs[i] != r; i++ {
+				if rs[i] == '\\' && i+1 < len(rs) {
+					i++
+				}
+				sb.WriteRune(rs[i])
+			}
+			if i >= len(rs) {
+				return nil, fmt.Errorf("unterminated string at %d", start)
+			}
+			i++
+			tokens = append(tokens, exprToken{"str", sb.String(), start})
+		case unicode.IsLetter(r) || r == '_' || r == '$':
+			start := i
+			for i < len(rs) {
+				c := rs[i]
+				if unicode.IsLetter(c) || unicode.IsDigit(c) || c == '_' || c == '$' || c == '.' {
+					i++
+				} else if c == '[' {
+					for i < len(rs) && rs[i] != ']' {
+						i++
+					}
+					if i >= len(rs) {
+						return nil, fmt.Errorf("unterminated index at %d", start)
+					}
+					i++
+				} else {
+					break
+				}
+			}
+			tokens = append(tokens, exprToken{"ident", string(rs[start:i]), start})
+		default:
+			op := string(r)
+			if i+1 < len(rs) {
+				switch two := string(rs[i : i+2]); two {
+				case "==", "!=", "<=", ">=", "&&", "||":
+					op = two
+				}
+			}
+			if !strings.Contains("+-*/%<>!?:(),", op) && len(op) == 1 {
+				return nil, fmt.Errorf("unexpected %q at %d", r, i)
+			}
+			tokens = append(tokens, exprToken{"op", op, i})
+			i += len(op)
+		}
+	}
+	return tokens, nil
+}
+
+type exprParser struct {
+	tokens []exprToken
+	pos    int
+}
+
+// parseExpr compiles src, reporting syntax errors and unknown functions
+func parseExpr(src string) (expr, error) {
+	tokens, err := lexExpr(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &exprParser{tokens: tokens}
+	e, err := p.ternary()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t != nil {
+		return nil, fmt.Errorf("unexpected %q at %d", t.text, t.pos)
+	}
+	return e, nil
+}
+
+func (p *exprParser) peek() *exprToken {
+	if p.pos < len(p.tokens) {
+		return &p.tokens[p.pos]
+	}
+	return nil
+}
+
+func (p *exprParser) accept(ops ...string) string {
+	if t := p.peek(); t != nil && t.kind == "op" {
+		for _, op := range ops {
+			if t.text == op {
+				p.pos++
+				return op
+			}
+		}
+	}
+	return ""
+}
+
+func (p *exprParser) expect(op string) error {
+	if p.accept(op) == "" {
+		if t := p.peek(); t != nil {
+			return fmt.Errorf("expected %q at %d but found %q", op, t.pos, t.text)
+		}
+		return fmt.Errorf("expected %q at end of expression", op)
+	}
+	return nil
+}
+
+func (p *exprParser) ternary() (expr, error) {
+	cond, err := p.binary(0)
+	if err != nil || p.accept("?") == "" {
+		return cond, err
+	}
+	yes, err := p.ternary()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expect(":"); err != nil {
+		return nil, err
+	}
+	no, err := p.ternary()
+	if err != nil {
+		return nil, err
+	}
+	return &condExpr{cond, yes, no}, nil
+}
+
+// binary operators from the lowest precedence
+var exprLevels = [][]string{
+	{"||"},
+	{"&&"},
+	{"==", "!=", "<", "<=", ">", ">="},
+	{"+", "-"},
+	{"*", "/", "%"},
+}
+
+func (p *exprParser) binary(level int) (expr, error) {
+	if level == len(exprLevels) {
+		return p.unary()
+	}
+	left, err := p.binary(level + 1)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op := p.accept(exprLevels[level]...)
+		if op == "" {
+			return left, nil
+		}
+		right, err := p.binary(level + 1)
+		if err != nil {
+			return nil, err
+		}
+		left = &binaryExpr{op, left, right}
+	}
+}
+
+func (p *exprParser) unary() (expr, error) {
+	if op := p.accept("-", "!"); op != "" {
+		e, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return &unaryExpr{op, e}, nil
+	}
+	return p.primary()
+}
+
+func (p *exprParser) primary() (expr, error) {
+	t := p.peek()
+	if t == nil {
+		return nil, fmt.Errorf("unexpected end of expression")
+	}
+	p.pos++
+	switch t.kind {
+	case "num":
+		if i, err := strconv.ParseInt(t.text, 10, 64); err == nil {
+			return &litExpr{i}, nil
+		}
+		f, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q at %d", t.text, t.pos)
+		}
+		return &litExpr{f}, nil
+	case "str":
+		return &litExpr{t.text}, nil
+	case "ident":
+		switch t.text {
+		case "true":
+			return &litExpr{true}, nil
+		case "false":
+			return &litExpr{false}, nil
+		case "null":
+			return &litExpr{nil}, nil
+		}
+		if p.accept("(") == "" {
+			if isSelector(t.text) {
+				if _, err := parseSelector(t.text, ""); err != nil {
+					return nil, err
+				}
+			}
+			return &nameExpr{t.text}, nil
+		}
+		fn, ok := exprFuncs[t.text]
+		if !ok {
+			return nil, fmt.Errorf("unknown function %s at %d", t.text, t.pos)
+		}
+		call := &callExpr{name: t.text, fn: fn}
+		if p.accept(")") == "" {
+			for {
+				arg, err := p.ternary()
+				if err != nil {
+					return nil, err
+				}
+				call.args = append(call.args, arg)
+				if p.accept(",") == "" {
+					break
+				}
+			}
+			if err := p.expect(")"); err != nil {
+				return nil, err
+			}
+		}
+		if n := len(call.args); n < fn.min || (fn.max >= 0 && n > fn.max) {
+			return nil, fmt.Errorf("wrong number of arguments for %s at %d", t.text, t.pos)
+		}
+		return call, nil
+	case "op":
+		if t.text == "(" {
+			e, err := p.ternary()
+			if err != nil {
+				return nil, err
+			}
+			return e, p.expect(")")
+		}
+	}
+	return nil, fmt.Errorf("unexpected %q at %d", t.text, t.pos)
+}
+
+type litExpr struct {
+	v interface{}
+}
+
+func (e *litExpr) eval(env exprEnv) (interface{}, error) {
+	return e.v, nil
+}
+
+type nameExpr struct {
+	name string
+}
+
+// eval returns nil for names which are not present
+func (e *nameExpr) eval(env exprEnv) (interface{}, error) {
+	v, _ := env(e.name)
+	return exprValue(v), nil
+}
+
+type condExpr struct {
+	cond, yes, no expr
+}
+
+func (e *condExpr) eval(env exprEnv) (interface{}, error) {
+	c, err := e.cond.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	if truthy(c) {
+		return e.yes.eval(env)
+	}
+	return e.no.eval(env)
+}
+
+type unaryExpr struct {
+	op string
+	e  expr
+}
+
+func (e *unaryExpr) eval(env exprEnv) (interface{}, error) {
+	v, err := e.e.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	if e.op == "!" {
+		return !truthy(v), nil
+	}
+	switch n := v.(type) {
+	case int64:
+		if n == math.MinInt64 {
+			return -float64(n), nil
+		}
+		return -n, nil
+	case float64:
+		return -n, nil
+	}
+	return nil, fmt.Errorf("cannot negate %T", v)
+}
+
+type binaryExpr struct {
+	op          string
+	left, right expr
+}
+
+func (e *binaryExpr) eval(env exprEnv) (interface{}, error) {
+	l, err := e.left.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	switch e.op {
+	case "&&":
+		if !truthy(l) {
+			return false, nil
+		}
+	case "||":
+		if truthy(l) {
+			return true, nil
+		}
+	}
+	r, err := e.right.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	switch e.op {
+	case "&&", "||":
+		return truthy(r), nil
+	case "==":
+		return exprEqual(l, r), nil
+	case "!=":
+		return !exprEqual(l, r), nil
+	case "<", "<=", ">", ">=":
+		c, ok := compareValues(l, r)
+		if !ok {
+			return nil, fmt.Errorf("cannot compare %T and %T", l, r)
+		}
+		switch e.op {
+		case "<":
+			return c < 0, nil
+		case "<=":
+			return c <= 0, nil
+		case ">":
+			return c > 0, nil
+		default:
+			return c >= 0, nil
+		}
+	}
+	if e.op == "+" {
+		_, ls := l.(string)
+		_, rs := r.(string)
+		if ls || rs {
+			return templateString(l) + templateString(r), nil
+		}
+	}
+	li, lInt := l.(int64)
+	ri, rInt := r.(int64)
+	if lInt && rInt && e.op != "/" {
+		if e.op == "%" {
+			if ri == 0 {
+				return nil, fmt.Errorf("division by zero")
+			}
+			return li % ri, nil
+		}
+		if n, ok := intArith(e.op, li, ri); ok {
+			return n, nil
+		}
+		// the result overflows int64 and is computed as a float
+	}
+	lf, lok := toFloat(l)
+	rf, rok := toFloat(r)
+	if !lok || !rok {
+		return nil, fmt.Errorf("cannot apply %s to %T and %T", e.op, l, r)
+	}
+	switch e.op {
+	case "+":
+		return lf + rf, nil
+	case "-":
+		return lf - rf, nil
+	case "*":
+		return lf * rf, nil
+	case "/":
+		if rf == 0 {
+			return nil, fmt.Errorf("division by zero")
+		}
+		return lf / rf, nil
+	default:
+		if rf == 0 {
+			return nil, fmt.Errorf("division by zero")
+		}
+		return math.Mod(lf, rf), nil
+	}
+}
+
+// intArith applies + - or * unless the result overflows int64
+func intArith(op string, l, r int64) (int64, bool) {
+	switch op {
+	case "+":
+		n := l + r
+		return n, (n > l) == (r > 0)
+	case "-":
+		n := l - r
+		return n, (n < l) == (r > 0)
+	case "*":
+		if l == 0 || r == 0 {
+			return 0, true
+		}
+		n := l * r
+		return n, n/r == l && !(l == -1 && r == math.MinInt64) && !(r == -1 && l == math.MinInt64)
+	}
+	return 0, false
+}
+
+type exprFunc struct {
+	min, max int
+	call     func(args []interface{}) (interface{}, error)
+}
+
+type callExpr struct {
+	name string
+	fn   *exprFunc
+	args []expr
+}
+
+func (e *callExpr) eval(env exprEnv) (interface{}, error) {
+	args := make([]interface{}, len(e.args))
+	for i, arg := range e.args {
+		v, err := arg.eval(env)
+		if err != nil {
+			return nil, err
+		}
+		args[i] = v
+	}
+	v, err := e.fn.call(args)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", e.name, err)
+	}
+	return v, nil
+}
+
+// exprValue converts document values to the int64, float64, string, bool or
+// nil used by expressions. Other values are kept for comparisons.
+func exprValue(v interface{}) interface{} {
+	if i, ok := toInt(v); ok {
+		return i
+	}
+	switch vt := v.(type) {
+	case float32:
+		return float64(vt)
+	case primitive.Decimal128:
+		if f, err := parseDecimal(vt); err == nil {
+			return f
+		}
+	case primitive.ObjectID:
+		return vt.Hex()
+	}
+	return v
+}
+
+func truthy(v interface{}) bool {
+	switch vt := v.(type) {
+	case nil:
+		return false
+	case bool:
+		return vt
+	case string:
+		return vt != ""
+	}
+	if f, ok := toFloat(v); ok {
+		return f != 0
+	}
+	return true
+}
+
+func exprEqual(l, r interface{}) bool {
+	if l == nil || r == nil {
+		return l == nil && r == nil
+	}
+	if c, ok := compareValues(l, r); ok {
+		return c == 0
+	}
+	return reflect.DeepEqual(l, r)
+}
+
+// parseNumber reads numbers from strings of any size, such as token amounts
+// in wei, dividing by 10^decimals with big precision before converting
+func parseNumber(v interface{}, decimals int64) (float64, error) {
+	if decimals < 0 {
+		return 0, fmt.Errorf("decimals must not be negative, got %d", decimals)
+	}
+	var f *big.Float
+	switch vt := v.(type) {
+	case string:
+		var ok bool
+		f, ok = new(big.Float).SetPrec(256).SetString(strings.TrimSpace(vt))
+		if !ok {
+			return 0, fmt.Errorf("%q is not a number", vt)
+		}
+	default:
+		n, ok := toFloat(v)
+		if !ok {
+			return 0, fmt.Errorf("cannot convert %T to a number", v)
+		}
+		f = new(big.Float).SetPrec(256).SetFloat64(n)
+	}
+	if decimals != 0 {
+		scale := new(big.Float).SetPrec(256).SetInt(new(big.Int).Exp(big.NewInt(10), big.NewInt(decimals), nil))
+		f.Quo(f, scale)
+	}
+	n, _ := f.Float64()
+	return n, nil
+}
+
+func stringArg(v interface{}) string {
+	return templateString(v)
+}
+
+func numberArg(v interface{}) (float64, error) {
+	if f, ok := toFloat(v); ok {
+		return f, nil
+	}
+	return parseNumber(v, 0)
+}
+
+func stringFunc(fn func(string) interface{}) *exprFunc {
+	return &exprFunc{1, 1, func(args []interface{}) (interface{}, error) {
+		return fn(stringArg(args[0])), nil
+	}}
+}
+
+func mathFunc(fn func(float64) float64) *exprFunc {
+	return &exprFunc{1, 1, func(args []interface{}) (interface{}, error) {
+		f, err := numberArg(args[0])
+		if err != nil {
+			return nil, err
+		}
+		return fn(f), nil
+	}}
+}
+
+var exprFuncs map[string]*exprFunc
+
+func init() {
+	exprFuncs = map[string]*exprFunc{
+		"lower": stringFunc(func(s string) interface{} { return strings.ToLower(s) }),
+		"upper": stringFunc(func(s string) interface{} { return strings.ToUpper(s) }),
+		"trim":  stringFunc(func(s string) interface{} { return strings.TrimSpace(s) }),
+		"len":   stringFunc(func(s string) interface{} { return int64(len(s)) }),
+		"str":   stringFunc(func(s string) interface{} { return s }),
+		"contains": {2, 2, func(args []interface{}) (interface{}, error) {
+			return strings.Contains(stringArg(args[0]), stringArg(args[1])), nil
+		}},
+		"startsWith": {2, 2, func(args []interface{}) (interface{}, error) {
+			return strings.HasPrefix(stringArg(args[0]), stringArg(args[1])), nil
+		}},
+		"endsWith": {2, 2, func(args []interface{}) (interface{}, error) {
+			return strings.HasSuffix(stringArg(args[0]), stringArg(args[1])), nil
+		}},
+		"replace": {3, 3, func(args []interface{}) (interface{}, error) {
+			return strings.Replace(stringArg(args[0]), stringArg(args[1]), stringArg(args[2]), -1), nil
+		}},
+		"substr": {2, 3, func(args []interface{}) (interface{}, error) {
+			s := stringArg(args[0])
+			start, ok := toInt(args[1])
+			end := int64(len(s))
+			if len(args) == 3 {
+				var endOk bool
+				end, endOk = toInt(args[2])
+				ok = ok && endOk
+			}
+			if !ok {
+				return nil, fmt.Errorf("positions must be integers")
+			}
+			if start < 0 {
+				start = 0
+			}
+			if end > int64(len(s)) {
+				end = int64(len(s))
+			}
+			if start >= end {
+				return "", nil
+			}
+			return s[start:end], nil
+		}},
+		"concat": {0, -1, func(args []interface{}) (interface{}, error) {
+			var sb strings.Builder
+			for _, arg := range args {
+				sb.WriteString(stringArg(arg))
+			}
+			return sb.String(), nil
+		}},
+		"num": {1, 2, func(args []interface{}) (interface{}, error) {
+			var decimals int64
+			if len(args) == 2 {
+				var ok bool
+				if decimals, ok = toInt(args[1]); !ok {
+					return nil, fmt.Errorf("decimals must be an integer")
+				}
+			}
+			return parseNumber(args[0], decimals)
+		}},
+		"int": {1, 1, func(args []interface{}) (interface{}, error) {
+			if i, ok := args[0].(int64); ok {
+				return i, nil
+			}
+			if s, ok := args[0].(string); ok {
+				if i, err := strconv.ParseInt(strings.TrimSpace(s), 10, 64); err == nil {
+					return i, nil
+				}
+			}
+			f, err := numberArg(args[0])
+			if err != nil {
+				return nil, err
+			}
+			if f >= math.MaxInt64 || f < math.MinInt64 || math.IsNaN(f) {
+				return nil, fmt.Errorf("%v is out of range", args[0])
+			}
+			return int64(f), nil
+		}},
+		"abs":   mathFunc(math.Abs),
+		"floor": mathFunc(math.Floor),
+		"ceil":  mathFunc(math.Ceil),
+		"round": {1, 2, func(args []interface{}) (interface{}, error) {
+			f, err := numberArg(args[0])
+			if err != nil {
+				return nil, err
+			}
+			var digits int64
+			if len(args) == 2 {
+				digits, _ = toInt(args[1])
+			}
+			scale := math.Pow(10, float64(digits))
+			return math.Round(f*scale) / scale, nil
+		}},
+		"min": {1, -1, func(args []interface{}) (interface{}, error) {
+			return extreme(args, -1)
+		}},
+		"max": {1, -1, func(args []interface{}) (interface{}, error) {
+			return extreme(args, 1)
+		}},
+		"coalesce": {1, -1, func(args []interface{}) (interface{}, error) {
+			for _, arg := range args {
+				if arg != nil {
+					return arg, nil
+				}
+			}
+			return nil, nil
+		}},
+	}
+}
+
+func extreme(args []interface{}, sign int) (interface{}, error) {
+	best := args[0]
+	for _, arg := range args[1:] {
+		c, ok := compareValues(arg, best)
+		if !ok {
+			return nil, fmt.Errorf("cannot compare %T and %T", arg, best)
+		}
+		if c*sign > 0 {
+			best = arg
+		}
+	}
+	return best, nil
+}
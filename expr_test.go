@@ -0,0 +1,150 @@
+package main
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+func exprTestEnv() exprEnv {
+	doc := map[string]interface{}{
+		"price":  12.5,
+		"qty":    int32(4),
+		"x":      2,
+		"pair":   "TOMO/USDT",
+		"amount": "2500000000000000000",
+		"big":    "123456789012345678901234567890",
+		"legs": []interface{}{
+			map[string]interface{}{"qty": 2},
+			map[string]interface{}{"qty": 4},
+		},
+	}
+	return func(name string) (interface{}, bool) {
+		return lookupPath(doc, name)
+	}
+}
+
+func TestExprEval(t *testing.T) {
+	tests := []struct {
+		src  string
+		want interface{}
+	}{
+		// precedence and associativity
+		{"1 + 2 * 3", int64(7)},
+		{"(1 + 2) * 3", int64(9)},
+		{"10 - 4 - 3", int64(3)},
+		{"2 * 3 % 4", int64(2)},
+		{"7 / 2", 3.5},
+		{"-2 * 3", int64(-6)},
+		{"--2", int64(2)},
+		{"1 + 2 == 3", true},
+		{"1 < 2 && 2 < 1 || true", true},
+		{"false && true || true", true},
+		{"!true || true", true},
+		{"!(1 > 2)", true},
+		{"price * qty", 50.0},
+		{"qty % 3", int64(1)},
+		// ternaries bind loosest and nest to the right
+		{"price > 10 ? 'high' : 'low'", "high"},
+		{"x > 2 ? 'a' : x > 1 ? 'b' : 'c'", "b"},
+		{"x > 1 ? x > 5 ? 'a' : 'b' : 'c'", "b"},
+		{"1 + 1 == x ? qty * 2 : 0", int64(8)},
+		// strings
+		{"'a' + 1", "a1"},
+		{"\"it's\" + ' ok'", "it's ok"},
+		{"upper(pair)", "TOMO/USDT"},
+		{"lower(replace(pair, '/', '_'))", "tomo_usdt"},
+		{"substr('abcdef', 1, 3)", "bc"},
+		{"concat(pair, ':', x)", "TOMO/USDT:2"},
+		{"startsWith(pair, 'TOMO') && !contains(pair, 'BTC')", true},
+		// wei amounts
+		{"num(amount, 18)", 2.5},
+		{"num(amount, 18) * qty", 10.0},
+		{"num(big, 18) > 1e11", true},
+		{"num('1e3')", 1000.0},
+		{"int('42') + 1", int64(43)},
+		// paths and null
+		{"legs[-1].qty", int64(4)},
+		{"legs[-2].qty + legs[1].qty", int64(6)},
+		{"legs[5].qty == null", true},
+		{"missing == null", true},
+		{"coalesce(missing, legs[0].qty)", int64(2)},
+		{"max(1, 3.5, 2)", 3.5},
+		{"round(2.5)", 3.0},
+		// int64 overflow falls back to float
+		{"9223372036854775807 + 1", float64(math.MaxInt64) + 1},
+		{"-9223372036854775807 - 2", -float64(math.MaxInt64) - 2},
+		{"3037000500 * 3037000500", float64(3037000500) * float64(3037000500)},
+		{"-(-9223372036854775807 - 1)", float64(math.MaxInt64) + 1},
+		{"3037000499 * 3037000499", int64(3037000499) * int64(3037000499)},
+	}
+	env := exprTestEnv()
+	for _, test := range tests {
+		e, err := parseExpr(test.src)
+		if err != nil {
+			t.Errorf("parseExpr(%q): %s", test.src, err)
+			continue
+		}
+		got, err := e.eval(env)
+		if err != nil {
+			t.Errorf("%s: %s", test.src, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s = %v (%T), want %v (%T)", test.src, got, got, test.want, test.want)
+		}
+	}
+}
+
+func TestExprParseErrors(t *testing.T) {
+	tests := []string{
+		"",
+		"1 +",
+		"(1 + 2",
+		"1 + 2)",
+		"1 2",
+		"1 # 2",
+		"'abc",
+		"legs[0",
+		"legs[x].qty",
+		"x ? 1",
+		"x ? 1 :",
+		"foo(1)",
+		"lower()",
+		"lower(1, 2)",
+		"num(1, 2, 3)",
+		"max(1,)",
+		"1..2",
+	}
+	for _, src := range tests {
+		if _, err := parseExpr(src); err == nil {
+			t.Errorf("parseExpr(%q) succeeded, want an error", src)
+		}
+	}
+}
+
+func TestExprEvalErrors(t *testing.T) {
+	tests := []string{
+		"1 / 0",
+		"5 % 0",
+		"'a' * 2",
+		"-'a'",
+		"'a' < 1",
+		"num('abc')",
+		"num(amount, 'x')",
+		"num(amount, -2)",
+		"int('1e30')",
+		"substr(pair, 'a')",
+	}
+	env := exprTestEnv()
+	for _, src := range tests {
+		e, err := parseExpr(src)
+		if err != nil {
+			t.Errorf("parseExpr(%q): %s", src, err)
+			continue
+		}
+		if v, err := e.eval(env); err == nil {
+			t.Errorf("%s = %v, want an error", src, v)
+		}
+	}
+}
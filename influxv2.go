@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// influxV2Sink writes line protocol to the /api/v2/write endpoint used by
+// InfluxDB 2.x and 3.x and authenticates with an API token
+type influxV2Sink struct {
+	addr       string
+	org        string
+	token      string
+	userAgent  string
+	httpClient *http.Client
+	orgMutex   sync.Mutex
+	orgID      string
+}
+
+// influxV2Error is an error answer of the API. Code and Message are decoded
+// from the JSON body when it has one.
+type influxV2Error struct {
+	Code       string `json:"code"`
+	Message    string `json:"message"`
+	status     string
+	statusCode int
+	method     string
+	path       string
+	body       string
+}
+
+func (e *influxV2Error) Error() string {
+	if e.Message != "" {
+		return fmt.Sprintf("InfluxDB %s %s: %s", e.method, e.path, e.Message)
+	}
+	return fmt.Sprintf("InfluxDB %s %s: %s: %s", e.method, e.path, e.status, e.body)
+}
+
+// codes of the API errors
+const (
+	influxV2NotFound = "not found"
+	influxV2Conflict = "conflict"
+)
+
+// hasCode tells whether err is an API error with the given status and code
+func hasCode(err error, status int, code string) bool {
+	e, ok := err.(*influxV2Error)
+	return ok && e.statusCode == status && e.Code == code
+}
+
+func newInfluxV2Sink(config *configOptions) (Sink, error) {
+	if _, err := url.Parse(config.InfluxURL); err != nil {
+		return nil, err
+	}
+	transport := &http.Transport{}
+	if config.InfluxPemFile != "" {
+		tlsConfig, err := config.InfluxTLS()
+		if err != nil {
+			return nil, err
+		}
+		transport.TLSClientConfig = tlsConfig
+	}
+	if config.InfluxSkipVerify {
+		if transport.TLSClientConfig == nil {
+			transport.TLSClientConfig = &tls.Config{}
+		}
+		transport.TLSClientConfig.InsecureSkipVerify = true
+	}
+	return &influxV2Sink{
+		addr:       strings.TrimSuffix(config.InfluxURL, "/"),
+		org:        config.InfluxOrg,
+		token:      config.InfluxToken,
+		userAgent:  fmt.Sprintf("%s v%s", Name, Version),
+		httpClient: &http.Client{Transport: transport},
+	}, nil
+}
+
+func (s *influxV2Sink) newRequest(method, path string, params url.Values, body []byte) (*http.Request, error) {
+	u := s.addr + path
+	if len(params) > 0 {
+		u += "?" + params.Encode()
+	}
+	req, err := http.NewRequest(method, u, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Token "+s.token)
+	req.Header.Set("User-Agent", s.userAgent)
+	return req, nil
+}
+
+// do sends the request and decodes a JSON response into out when given. An
+// answer other than success is returned as an *influxV2Error.
+func (s *influxV2Sink) do(req *http.Request, out interface{}) error {
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode/100 != 2 {
+		e := &influxV2Error{
+			status:     resp.Status,
+			statusCode: resp.StatusCode,
+			method:     req.Method,
+			path:       req.URL.Path,
+		}
+		if json.Unmarshal(body, e) != nil {
+			e.Code, e.Message = "", ""
+		}
+		if e.Message == "" {
+			e.body = strings.TrimSpace(string(body))
+		}
+		return e
+	}
+	if out != nil && len(body) > 0 {
+		return json.Unmarshal(body, out)
+	}
+	return nil
+}
+
+func (s *influxV2Sink) ValidPrecision(precision string) bool {
+	switch precision {
+	case "ns", "us", "ms", "s":
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *influxV2Sink) WriteBatch(batch *Batch) error {
+	if len(batch.Points) == 0 {
+		return nil
+	}
+	var b bytes.Buffer
+	for _, pt := range batch.Points {
+		b.WriteString(pt.PrecisionString(batch.Precision))
+		b.WriteByte('\n')
+	}
+	params := url.Values{}
+	params.Set("bucket", batch.Database)
+	params.Set("precision", batch.Precision)
+	if s.org != "" {
+		params.Set("org", s.org)
+	}
+	req, err := s.newRequest("POST", "/api/v2/write", params, b.Bytes())
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	return s.do(req, nil)
+}
+
+// DeletePoint deletes the series point at the exact time through the
+// /api/v2/delete endpoint
+func (s *influxV2Sink) DeletePoint(ref *pointRef) error {
+	predicate := []string{fmt.Sprintf(`_measurement="%s"`, escapePredicate(ref.Name))}
+	for k, v := range ref.Tags {
+		predicate = append(predicate, fmt.Sprintf(`%s="%s"`, k, escapePredicate(v)))
+	}
+	body, err := json.Marshal(map[string]string{
+		"start":     ref.Time.Format(time.RFC3339Nano),
+		"stop":      ref.Time.Add(time.Nanosecond).Format(time.RFC3339Nano),
+		"predicate": strings.Join(predicate, " AND "),
+	})
+	if err != nil {
+		return err
+	}
+	params := url.Values{}
+	params.Set("bucket", ref.Database)
+	if s.org != "" {
+		params.Set("org", s.org)
+	}
+	req, err := s.newRequest("POST", "/api/v2/delete", params, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return s.do(req, nil)
+}
+
+func escapePredicate(s string) string {
+	return strings.Replace(s, `"`, `\"`, -1)
+}
+
+func (s *influxV2Sink) lookupOrgID() (string, error) {
+	s.orgMutex.Lock()
+	defer s.orgMutex.Unlock()
+	if s.orgID != "" {
+		return s.orgID, nil
+	}
+	if s.org == "" {
+		return "", fmt.Errorf("influx-org is required to create InfluxDB buckets")
+	}
+	params := url.Values{}
+	params.Set("org", s.org)
+	req, err := s.newRequest("GET", "/api/v2/orgs", params, nil)
+	if err != nil {
+		return "", err
+	}
+	var result struct {
+		Orgs []struct {
+			ID string `json:"id"`
+		} `json:"orgs"`
+	}
+	if err = s.do(req, &result); err != nil {
+		return "", err
+	}
+	if len(result.Orgs) == 0 {
+		return "", fmt.Errorf("InfluxDB organization %s not found", s.org)
+	}
+	s.orgID = result.Orgs[0].ID
+	return s.orgID, nil
+}
+
+// EnsureDatabase creates the bucket unless it already exists. Servers without
+// the buckets API, such as InfluxDB 3.x, create the bucket on first write.
+func (s *influxV2Sink) EnsureDatabase(name string) error {
+	params := url.Values{}
+	params.Set("name", name)
+	if s.org != "" {
+		params.Set("org", s.org)
+	}
+	req, err := s.newRequest("GET", "/api/v2/buckets", params, nil)
+	if err != nil {
+		return err
+	}
+	var result struct {
+		Buckets []struct {
+			Name string `json:"name"`
+		} `json:"buckets"`
+	}
+	if err = s.do(req, &result); isPathNotFound(err) {
+		return nil
+	} else if err != nil && !hasCode(err, http.StatusNotFound, influxV2NotFound) {
+		return err
+	}
+	// 2.x answers a missing bucket or organization with not found. The
+	// organization is looked up before creating the bucket and reports the
+	// latter.
+	for _, b := range result.Buckets {
+		if b.Name == name {
+			return nil
+		}
+	}
+	orgID, err := s.lookupOrgID()
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(map[string]interface{}{
+		"orgID":          orgID,
+		"name":           name,
+		"retentionRules": []interface{}{},
+	})
+	if err != nil {
+		return err
+	}
+	if req, err = s.newRequest("POST", "/api/v2/buckets", nil, body); err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	// the bucket may have been created by another worker in the meantime
+	if err = s.do(req, nil); hasCode(err, http.StatusConflict, influxV2Conflict) ||
+		hasCode(err, http.StatusUnprocessableEntity, influxV2Conflict) {
+		return nil
+	}
+	return err
+}
+
+// isPathNotFound tells whether a not found answer is about the endpoint rather
+// than a resource, i.e. the server has no such API. Those servers do not
+// answer with an API error code.
+func isPathNotFound(err error) bool {
+	e, ok := err.(*influxV2Error)
+	return ok && e.statusCode == http.StatusNotFound && e.Code == ""
+}
+
+func (s *influxV2Sink) Close() error {
+	s.httpClient.CloseIdleConnections()
+	return nil
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// fakeInfluxV2 answers the buckets and orgs API of an InfluxDB 2.x server
+// holding the org tomochain with the given buckets
+type fakeInfluxV2 struct {
+	buckets  map[string]bool
+	noAPI    bool
+	conflict bool
+	created  []string
+}
+
+func (f *fakeInfluxV2) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	fail := func(status int, code, message string) {
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]string{"code": code, "message": message})
+	}
+	if f.noAPI {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	org := r.URL.Query().Get("org")
+	switch {
+	case r.Method == "GET" && r.URL.Path == "/api/v2/buckets":
+		if org != "" && org != "tomochain" {
+			fail(http.StatusNotFound, "not found", `organization name "`+org+`" not found`)
+			return
+		}
+		name := r.URL.Query().Get("name")
+		if !f.buckets[name] {
+			fail(http.StatusNotFound, "not found", `bucket "`+name+`" not found`)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"buckets": []map[string]string{{"name": name}},
+		})
+	case r.Method == "GET" && r.URL.Path == "/api/v2/orgs":
+		if org != "tomochain" {
+			fail(http.StatusNotFound, "not found", `organization name "`+org+`" not found`)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"orgs": []map[string]string{{"id": "0123"}},
+		})
+	case r.Method == "POST" && r.URL.Path == "/api/v2/buckets":
+		var body map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&body)
+		if f.conflict {
+			fail(http.StatusUnprocessableEntity, "conflict", "bucket with name trades already exists")
+			return
+		}
+		if body["orgID"] != "0123" {
+			fail(http.StatusBadRequest, "invalid", "unknown orgID")
+			return
+		}
+		f.created = append(f.created, body["name"].(string))
+		w.WriteHeader(http.StatusCreated)
+	default:
+		fail(http.StatusNotFound, "not found", "path not found")
+	}
+}
+
+func TestInfluxV2EnsureDatabase(t *testing.T) {
+	tests := []struct {
+		name    string
+		org     string
+		server  *fakeInfluxV2
+		created bool
+		fails   bool
+	}{
+		{"existing bucket", "tomochain", &fakeInfluxV2{buckets: map[string]bool{"trades": true}}, false, false},
+		{"missing bucket", "tomochain", &fakeInfluxV2{}, true, false},
+		{"created meanwhile", "tomochain", &fakeInfluxV2{conflict: true}, false, false},
+		{"unknown org", "other", &fakeInfluxV2{}, false, true},
+		{"no org", "", &fakeInfluxV2{}, false, true},
+		{"no buckets API", "", &fakeInfluxV2{noAPI: true}, false, false},
+	}
+	for _, test := range tests {
+		server := httptest.NewServer(test.server)
+		sink, err := newInfluxV2Sink(&configOptions{
+			InfluxURL: server.URL,
+			InfluxOrg: test.org,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = sink.EnsureDatabase("trades")
+		if (err != nil) != test.fails {
+			t.Errorf("%s: EnsureDatabase returned %v", test.name, err)
+		}
+		if created := len(test.server.created) > 0; created != test.created {
+			t.Errorf("%s: expected bucket created %t, got %v", test.name, test.created, test.server.created)
+		}
+		server.Close()
+	}
+}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	stdoutSinkName = "stdout"
+	fileSinkName   = "file"
+)
+
+type fileSinkSettings struct {
+	Path           string
+	RotateSize     int64  `toml:"rotate-size"`
+	RotateInterval string `toml:"rotate-interval"`
+	Gzip           bool
+}
+
+// writeHeader writes the preamble understood by influx -import. influx only
+// accepts DDL before the first # DML so every database is created up front.
+// The precision is not part of the file and is given with -precision.
+func writeHeader(w io.Writer, dbs []string) error {
+	if len(dbs) > 0 {
+		if _, err := fmt.Fprintln(w, "# DDL"); err != nil {
+			return err
+		}
+		for _, db := range dbs {
+			if _, err := fmt.Fprintf(w, "CREATE DATABASE \"%s\"\n", db); err != nil {
+				return err
+			}
+		}
+		if _, err := fmt.Fprintln(w); err != nil {
+			return err
+		}
+	}
+	_, err := fmt.Fprintln(w, "# DML")
+	return err
+}
+
+func writeDatabase(w io.Writer, db string) error {
+	_, err := fmt.Fprintf(w, "# CONTEXT-DATABASE: %s\n", db)
+	return err
+}
+
+// writeRetention switches the retention policy, where an empty one returns
+// to the default policy of the database
+func writeRetention(w io.Writer, retention string) error {
+	_, err := fmt.Fprintf(w, "# CONTEXT-RETENTION-POLICY: %s\n", retention)
+	return err
+}
+
+func writePoints(w io.Writer, b *Batch) (n int64, err error) {
+	for _, pt := range b.Points {
+		var c int
+		if c, err = fmt.Fprintln(w, pt.PrecisionString(b.Precision)); err != nil {
+			return
+		}
+		n += int64(c)
+	}
+	return
+}
+
+// stdoutSink prints points as line protocol. Log output moves to stderr so
+// that stdout only carries points. The stream is a single influx -import
+// file so every measurement must use the same precision.
+type stdoutSink struct {
+	sync.Mutex
+	w         *bufio.Writer
+	createDB  bool
+	databases map[string]bool
+	started   bool
+	database  string
+	precision string
+	retention string
+}
+
+func newStdoutSink(config *configOptions) (Sink, error) {
+	infoLog.SetOutput(os.Stderr)
+	errorLog.SetOutput(os.Stderr)
+	return &stdoutSink{
+		w:         bufio.NewWriter(os.Stdout),
+		createDB:  config.InfluxAutoCreateDB,
+		databases: make(map[string]bool),
+	}, nil
+}
+
+func (s *stdoutSink) EnsureDatabase(db string) error {
+	return nil
+}
+
+// CheckTargets checks that the measurements share a precision, which cannot
+// change once points are out
+func (s *stdoutSink) CheckTargets(targets []*Batch) error {
+	s.Lock()
+	defer s.Unlock()
+	_, err := s.checkTargets(targets)
+	return err
+}
+
+func (s *stdoutSink) checkTargets(targets []*Batch) (string, error) {
+	precision := ""
+	for _, t := range targets {
+		if precision == "" {
+			precision = t.Precision
+		} else if t.Precision != precision {
+			return "", fmt.Errorf("the %s sink requires a single precision, measurements use %s and %s",
+				stdoutSinkName, precision, t.Precision)
+		}
+	}
+	if s.started && precision != s.precision {
+		return "", fmt.Errorf("the %s sink cannot change precision from %s to %s", stdoutSinkName, s.precision, precision)
+	}
+	for _, t := range targets {
+		if s.started && s.createDB && !s.databases[t.Database] {
+			return "", fmt.Errorf("the %s sink cannot create database %s after points were written", stdoutSinkName, t.Database)
+		}
+	}
+	return precision, nil
+}
+
+// SetTargets collects the databases to create and sets the precision
+func (s *stdoutSink) SetTargets(targets []*Batch) error {
+	s.Lock()
+	defer s.Unlock()
+	precision, err := s.checkTargets(targets)
+	if err != nil {
+		return err
+	}
+	for _, t := range targets {
+		s.databases[t.Database] = true
+	}
+	s.precision = precision
+	return nil
+}
+
+func (s *stdoutSink) WriteBatch(b *Batch) error {
+	if len(b.Points) == 0 {
+		return nil
+	}
+	s.Lock()
+	defer s.Unlock()
+	if !s.started {
+		var dbs []string
+		if s.createDB {
+			s.databases[b.Database] = true
+			for db := range s.databases {
+				dbs = append(dbs, db)
+			}
+			sort.Strings(dbs)
+		}
+		if err := writeHeader(s.w, dbs); err != nil {
+			return err
+		}
+		if s.precision == "" {
+			s.precision = b.Precision
+		}
+		s.started = true
+	}
+	if b.Precision != s.precision {
+		return fmt.Errorf("the %s sink writes precision %s, not %s", stdoutSinkName, s.precision, b.Precision)
+	}
+	if b.Database != s.database {
+		if err := writeDatabase(s.w, b.Database); err != nil {
+			return err
+		}
+		s.database = b.Database
+	}
+	if b.RetentionPolicy != s.retention {
+		if err := writeRetention(s.w, b.RetentionPolicy); err != nil {
+			return err
+		}
+		s.retention = b.RetentionPolicy
+	}
+	if _, err := writePoints(s.w, b); err != nil {
+		return err
+	}
+	return s.w.Flush()
+}
+
+func (s *stdoutSink) Close() error {
+	s.Lock()
+	defer s.Unlock()
+	return s.w.Flush()
+}
+
+// lineFile is an open export file for a single database and precision
+type lineFile struct {
+	f         *os.File
+	gz        *gzip.Writer
+	w         *bufio.Writer
+	size      int64
+	opened    time.Time
+	retention string
+}
+
+func (lf *lineFile) close() error {
+	err := lf.w.Flush()
+	if lf.gz != nil {
+		if gzErr := lf.gz.Close(); err == nil {
+			err = gzErr
+		}
+	}
+	if fErr := lf.f.Close(); err == nil {
+		err = fErr
+	}
+	return err
+}
+
+// fileSink writes points as line protocol to files under a directory, one
+// file per database and precision, rotating by size and/or age
+type fileSink struct {
+	sync.Mutex
+	dir            string
+	rotateSize     int64
+	rotateInterval time.Duration
+	gzip           bool
+	createDB       bool
+	files          map[string]*lineFile
+	seq            int
+}
+
+func newFileSink(config *configOptions) (Sink, error) {
+	settings := config.FileSink
+	s := &fileSink{
+		dir:        settings.Path,
+		rotateSize: settings.RotateSize,
+		gzip:       settings.Gzip,
+		createDB:   config.InfluxAutoCreateDB,
+		files:      make(map[string]*lineFile),
+	}
+	if s.dir == "" {
+		s.dir = "."
+	}
+	if settings.RotateInterval != "" {
+		d, err := time.ParseDuration(settings.RotateInterval)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to parse file sink rotate interval %s: %s", settings.RotateInterval, err)
+		}
+		s.rotateInterval = d
+	}
+	if err := os.MkdirAll(s.dir, 0755); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *fileSink) EnsureDatabase(db string) error {
+	return nil
+}
+
+func (s *fileSink) open(b *Batch) (*lineFile, error) {
+	s.seq++
+	name := fmt.Sprintf("%s_%s_%s_%d.lp", b.Database, b.Precision,
+		time.Now().UTC().Format("20060102T150405"), s.seq)
+	if s.gzip {
+		name += ".gz"
+	}
+	f, err := os.Create(filepath.Join(s.dir, name))
+	if err != nil {
+		return nil, err
+	}
+	lf := &lineFile{f: f, opened: time.Now()}
+	if s.gzip {
+		lf.gz = gzip.NewWriter(f)
+		lf.w = bufio.NewWriter(lf.gz)
+	} else {
+		lf.w = bufio.NewWriter(f)
+	}
+	var dbs []string
+	if s.createDB {
+		dbs = []string{b.Database}
+	}
+	if err = writeHeader(lf.w, dbs); err == nil {
+		err = writeDatabase(lf.w, b.Database)
+	}
+	if err != nil {
+		lf.close()
+		return nil, err
+	}
+	return lf, nil
+}
+
+func (s *fileSink) expired(lf *lineFile) bool {
+	if s.rotateSize > 0 && lf.size >= s.rotateSize {
+		return true
+	}
+	if s.rotateInterval > 0 && time.Since(lf.opened) >= s.rotateInterval {
+		return true
+	}
+	return false
+}
+
+func (s *fileSink) WriteBatch(b *Batch) error {
+	if len(b.Points) == 0 {
+		return nil
+	}
+	s.Lock()
+	defer s.Unlock()
+	key := b.Database + "\x00" + b.Precision
+	lf := s.files[key]
+	if lf != nil && s.expired(lf) {
+		delete(s.files, key)
+		if err := lf.close(); err != nil {
+			return err
+		}
+		lf = nil
+	}
+	if lf == nil {
+		var err error
+		if lf, err = s.open(b); err != nil {
+			return err
+		}
+		s.files[key] = lf
+	}
+	if b.RetentionPolicy != lf.retention {
+		if err := writeRetention(lf.w, b.RetentionPolicy); err != nil {
+			return err
+		}
+		lf.retention = b.RetentionPolicy
+	}
+	n, err := writePoints(lf.w, b)
+	lf.size += n
+	if err != nil {
+		return err
+	}
+	return lf.w.Flush()
+}
+
+func (s *fileSink) Close() (err error) {
+	s.Lock()
+	defer s.Unlock()
+	for key, lf := range s.files {
+		if cErr := lf.close(); err == nil {
+			err = cErr
+		}
+		delete(s.files, key)
+	}
+	return
+}
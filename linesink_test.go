@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	client "github.com/influxdata/influxdb1-client/v2"
+)
+
+func linesBatch(t *testing.T, db, precision string, n int) *Batch {
+	b := &Batch{Database: db, Precision: precision}
+	for i := 0; i < n; i++ {
+		pt, err := client.NewPoint("trades", map[string]string{"pair": "TOMO/USDT"},
+			map[string]interface{}{"price": float64(i)}, time.Unix(1600000000, 123456789))
+		if err != nil {
+			t.Fatal(err)
+		}
+		b.Points = append(b.Points, pt)
+	}
+	return b
+}
+
+// readExports returns the contents of the export files in dir by name
+func readExports(t *testing.T, dir string) ([]string, map[string]string) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	contents := make(map[string]string)
+	for _, info := range infos {
+		f, err := os.Open(filepath.Join(dir, info.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var r io.Reader = f
+		if strings.HasSuffix(info.Name(), ".gz") {
+			if r, err = gzip.NewReader(f); err != nil {
+				t.Fatal(err)
+			}
+		}
+		data, err := ioutil.ReadAll(r)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, info.Name())
+		contents[info.Name()] = string(data)
+	}
+	sort.Strings(names)
+	return names, contents
+}
+
+func TestStdoutSinkCheckTargetsLeavesSink(t *testing.T) {
+	s := &stdoutSink{
+		w:         bufio.NewWriter(&bytes.Buffer{}),
+		createDB:  true,
+		databases: make(map[string]bool),
+	}
+	if err := s.SetTargets([]*Batch{{Database: "trades", Precision: "ms"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.CheckTargets([]*Batch{{Database: "orders", Precision: "ms"}}); err != nil {
+		t.Fatal(err)
+	}
+	if s.databases["orders"] || s.precision != "ms" {
+		t.Errorf("expected CheckTargets to leave the sink, got databases %v precision %s", s.databases, s.precision)
+	}
+	mixed := []*Batch{{Database: "trades", Precision: "ms"}, {Database: "trades", Precision: "s"}}
+	if err := s.CheckTargets(mixed); err == nil {
+		t.Errorf("expected mixed precisions to be rejected")
+	}
+	if err := s.SetTargets(mixed); err == nil || s.precision != "ms" {
+		t.Errorf("expected a rejected SetTargets to keep precision ms, got %s (%v)", s.precision, err)
+	}
+}
+
+func TestStdoutSinkSinglePrecision(t *testing.T) {
+	var out bytes.Buffer
+	s := &stdoutSink{
+		w:         bufio.NewWriter(&out),
+		createDB:  true,
+		databases: make(map[string]bool),
+	}
+	if err := s.SetTargets([]*Batch{{Database: "trades", Precision: "ms"}, {Database: "orders", Precision: "ms"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.WriteBatch(linesBatch(t, "trades", "ms", 1)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.WriteBatch(linesBatch(t, "trades", "s", 1)); err == nil {
+		t.Errorf("expected a batch of another precision to be rejected")
+	}
+	if err := s.CheckTargets([]*Batch{{Database: "trades", Precision: "s"}}); err == nil {
+		t.Errorf("expected a change of precision to be rejected once points are out")
+	}
+	if err := s.CheckTargets([]*Batch{{Database: "volume", Precision: "ms"}}); err == nil {
+		t.Errorf("expected a new database to be rejected once points are out")
+	}
+	want := "# DDL\nCREATE DATABASE \"orders\"\nCREATE DATABASE \"trades\"\n\n# DML\n" +
+		"# CONTEXT-DATABASE: trades\n" +
+		"trades,pair=TOMO/USDT price=0 1600000000123\n"
+	if out.String() != want {
+		t.Errorf("unexpected output:\n%s\nwant:\n%s", out.String(), want)
+	}
+}
+
+func TestFileSinkRotation(t *testing.T) {
+	for _, gz := range []bool{false, true} {
+		dir, err := ioutil.TempDir("", "mongofluxd")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		sink, err := newFileSink(&configOptions{
+			InfluxAutoCreateDB: true,
+			FileSink:           fileSinkSettings{Path: dir, RotateSize: 100, Gzip: gz},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		// a batch of 3 points passes the rotate size so each one starts a file
+		for i := 0; i < 2; i++ {
+			if err := sink.WriteBatch(linesBatch(t, "trades", "s", 3)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := sink.WriteBatch(linesBatch(t, "orders", "ms", 1)); err != nil {
+			t.Fatal(err)
+		}
+		if err := sink.Close(); err != nil {
+			t.Fatal(err)
+		}
+		names, contents := readExports(t, dir)
+		if len(names) != 3 {
+			t.Fatalf("gzip %t: expected 3 files, got %v", gz, names)
+		}
+		trades := 0
+		for _, name := range names {
+			if strings.HasSuffix(name, ".gz") != gz {
+				t.Errorf("gzip %t: unexpected file name %s", gz, name)
+			}
+			content := contents[name]
+			switch {
+			case strings.HasPrefix(name, "trades_s_"):
+				trades++
+				want := "# DDL\nCREATE DATABASE \"trades\"\n\n# DML\n# CONTEXT-DATABASE: trades\n"
+				if !strings.HasPrefix(content, want) || strings.Count(content, "1600000000\n") != 3 {
+					t.Errorf("gzip %t: unexpected content of %s:\n%s", gz, name, content)
+				}
+			case strings.HasPrefix(name, "orders_ms_"):
+				if !strings.HasSuffix(content, "trades,pair=TOMO/USDT price=0 1600000000123\n") {
+					t.Errorf("gzip %t: unexpected content of %s:\n%s", gz, name, content)
+				}
+			default:
+				t.Errorf("gzip %t: unexpected file %s", gz, name)
+			}
+		}
+		if trades != 2 {
+			t.Errorf("gzip %t: expected the trades file to rotate once, got %v", gz, names)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/rwynn/gtm"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+const lookupBatchSize = 100
+
+// needsLookup reports whether an update carries only part of the document,
+// i.e. it is a change stream delta or a required key or the timefield is
+// absent. Missing optional tags and fields are not looked up, the fetched
+// document would lack them as well.
+func (im *InfluxMeasure) needsLookup(op *gtm.Op) bool {
+	if !im.updateLookup || im.view != nil || !op.IsUpdate() {
+		return false
+	}
+	return isDelta(op) || len(im.missingFields(op.Data)) > 0
+}
+
+// isDelta reports whether op holds the change of an update rather than the
+// document. Full documents always carry their _id.
+func isDelta(op *gtm.Op) bool {
+	if len(op.Data) == 0 {
+		return true
+	}
+	if op.UpdateDescription == nil {
+		return false
+	}
+	_, full := op.Data["_id"]
+	return !full
+}
+
+// pendingLookup is a partial update waiting for its full document along with
+// the measurements to map it with
+type pendingLookup struct {
+	op       *gtm.Op
+	measures []*InfluxMeasure
+}
+
+// queueLookup holds a partial update until its full document is fetched
+func (ctx *InfluxCtx) queueLookup(op *gtm.Op, measures []*InfluxMeasure) {
+	ctx.checkpoints.hold(op)
+	ctx.lookups = append(ctx.lookups, &pendingLookup{op: op, measures: measures})
+	if len(ctx.lookups) >= lookupBatchSize {
+		ctx.flushLookups()
+	}
+}
+
+func idKey(id interface{}) string {
+	return fmt.Sprintf("%T:%v", id, id)
+}
+
+// flushLookups fetches the current documents of the queued updates by _id,
+// one query per namespace, and maps them
+func (ctx *InfluxCtx) flushLookups() {
+	if len(ctx.lookups) == 0 || ctx.fetching {
+		return
+	}
+	ctx.fetching = true
+	defer func() {
+		ctx.fetching = false
+	}()
+	byNs := make(map[string][]*pendingLookup)
+	for _, l := range ctx.lookups {
+		byNs[l.op.Namespace] = append(byNs[l.op.Namespace], l)
+	}
+	ctx.lookups = nil
+	for ns, lookups := range byNs {
+		docs, err := ctx.fetchDocs(ns, lookups)
+		for _, l := range lookups {
+			op := l.op
+			if err != nil {
+				ctx.fail(op, stageMap, err)
+			} else if doc, found := docs[idKey(op.Id)]; found {
+				fetched := *op
+				fetched.Data = doc
+				if err := ctx.addPointTo(&fetched, l.measures); err != nil {
+					ctx.fail(op, stageMap, err)
+				}
+			} else if ctx.config.Verbose {
+				infoLog.Printf("Document %v in namespace %s was not found for update lookup\n", op.Id, ns)
+			}
+			ctx.checkpoints.release(op)
+		}
+	}
+}
+
+func (ctx *InfluxCtx) fetchDocs(ns string, lookups []*pendingLookup) (map[string]map[string]interface{}, error) {
+	dbCol := strings.SplitN(ns, ".", 2)
+	if len(dbCol) != 2 {
+		return nil, fmt.Errorf("Unable to look up updates in invalid namespace %s", ns)
+	}
+	var ids []interface{}
+	for _, l := range lookups {
+		ids = append(ids, l.op.Id)
+	}
+	col := ctx.client.Database(dbCol[0]).Collection(dbCol[1])
+	cursor, err := col.Find(context.Background(), bson.M{"_id": bson.M{"$in": ids}})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(context.Background())
+	docs := make(map[string]map[string]interface{})
+	for cursor.Next(context.Background()) {
+		doc := make(map[string]interface{})
+		if err = cursor.Decode(&doc); err != nil {
+			return nil, err
+		}
+		doc, _ = normalizeDoc(doc).(map[string]interface{})
+		docs[idKey(doc["_id"])] = doc
+	}
+	return docs, cursor.Err()
+}
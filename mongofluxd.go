@@ -13,9 +13,10 @@ import (
 	"os/signal"
 	"plugin"
 	"reflect"
+	"regexp"
 	"strconv"
 	"strings"
-	"sync"
+	"sync/atomic"
 	"syscall"
 	"text/template"
 	"time"
@@ -47,6 +48,23 @@ const (
 	gtmChannelSizeDefault = 512
 )
 
+const (
+	onMissingSkip       = "skip"
+	onMissingError      = "error"
+	onMissingDeadLetter = "deadletter"
+)
+
+// docCounters tracks what happened to documents that did not become points
+type docCounters struct {
+	filtered     int64
+	skipped      int64
+	deadLettered int64
+	failed       int64
+	rejected     int64
+}
+
+var counters docCounters
+
 type resumeStrategy int
 
 const (
@@ -74,18 +92,47 @@ type gtmSettings struct {
 	BufferDuration string `toml:"buffer-duration"`
 }
 
+type filterSettings struct {
+	Field    string
+	Operator string
+	Values   []interface{}
+	Optional bool
+}
+
 type measureSettings struct {
-	Namespace string
-	View      string
-	Timefield string
-	Retention string
-	Precision string
-	Measure   string
-	Database  string
-	Symbol    string
-	Tags      []string
-	Fields    []string
-	plug      func(*mongofluxdplug.MongoDocument) ([]*mongofluxdplug.InfluxPoint, error)
+	ID             string `toml:"id"`
+	Namespace      string
+	NamespaceRegex string `toml:"namespace-regex"`
+	View           string
+	Timefield      string
+	Retention      string
+	Precision      string
+	Measure        string
+	Database       string
+	Bucket         string
+	Symbol         string
+	Tags           []string
+	Fields         []string
+	FieldTypes     []string `toml:"field-types"`
+	Defaults       map[string]interface{}
+	Required       []string
+	OnMissing      string            `toml:"on-missing"`
+	OnDelete       string            `toml:"on-delete"`
+	UpdateLookup   bool              `toml:"update-lookup"`
+	ComputedFields map[string]string `toml:"computed-fields"`
+	ComputedTags   map[string]string `toml:"computed-tags"`
+	TimeFormat     string            `toml:"timefield-format"`
+	Timezone       string
+	TagIntFormat   string   `toml:"tag-int-format"`
+	TagTimeFormat  string   `toml:"tag-time-format"`
+	RawTags        []string `toml:"raw-tags"`
+	Explode        string
+	ExplodeTime    string `toml:"explode-timefield"`
+	ExplodeIndex   string `toml:"explode-index-tag"`
+	Tombstone      string `toml:"tombstone-field"`
+	Filter         []*filterSettings
+	PluginConfig   map[string]interface{} `toml:"plugin-config"`
+	plug           mongofluxdplug.Plugin
 }
 
 type configOptions struct {
@@ -106,15 +153,21 @@ type configOptions struct {
 	InfluxURL                string `toml:"influx-url"`
 	InfluxUser               string `toml:"influx-user"`
 	InfluxPassword           string `toml:"influx-password"`
-	InfluxSkipVerify         bool   `toml:"influx-skip-verify"`
-	InfluxPemFile            string `toml:"influx-pem-file"`
-	InfluxAutoCreateDB       bool   `toml:"influx-auto-create-db"`
-	InfluxClients            int    `toml:"influx-clients"`
-	InfluxBufferSize         int    `toml:"influx-buffer-size"`
-	DirectReads              bool   `toml:"direct-reads"`
-	ChangeStreams            bool   `toml:"change-streams"`
-	ExitAfterDirectReads     bool   `toml:"exit-after-direct-reads"`
-	PluginPath               string `toml:"plugin-path"`
+	InfluxOrg                string `toml:"influx-org"`
+	InfluxToken              string `toml:"influx-token"`
+	Sink                     string
+	DeadLetter               bool             `toml:"dead-letter"`
+	FileSink                 fileSinkSettings `toml:"file-sink"`
+	WriteRetry               retrySettings    `toml:"write-retry"`
+	InfluxSkipVerify         bool             `toml:"influx-skip-verify"`
+	InfluxPemFile            string           `toml:"influx-pem-file"`
+	InfluxAutoCreateDB       bool             `toml:"influx-auto-create-db"`
+	InfluxClients            int              `toml:"influx-clients"`
+	InfluxBufferSize         int              `toml:"influx-buffer-size"`
+	DirectReads              bool             `toml:"direct-reads"`
+	ChangeStreams            bool             `toml:"change-streams"`
+	ExitAfterDirectReads     bool             `toml:"exit-after-direct-reads"`
+	PluginPath               string           `toml:"plugin-path"`
 }
 
 type dbcol struct {
@@ -122,33 +175,72 @@ type dbcol struct {
 	col string
 }
 
+type docFilter struct {
+	field    string
+	operator string
+	values   []interface{}
+	regexps  []*regexp.Regexp
+	exists   bool
+	// optional passes documents without the field
+	optional bool
+}
+
 type InfluxMeasure struct {
-	ns         string
-	view       *dbcol
-	timefield  string
-	retention  string
-	precision  string
-	measure    string
-	measureTpl *template.Template
-	database   string
-	tags       map[string]string
-	fields     map[string]string
-	plug       func(*mongofluxdplug.MongoDocument) ([]*mongofluxdplug.InfluxPoint, error)
+	key            string
+	pattern        *nsPattern
+	ns             string
+	view           *dbcol
+	timefield      string
+	retention      string
+	precision      string
+	measure        string
+	measureTpl     *template.Template
+	database       string
+	tags           map[string]string
+	fields         map[string]string
+	tagSelectors   []*pathSelector
+	fieldSelectors []*pathSelector
+	timeSelector   *pathSelector
+	computedTags   []*computedValue
+	computedFields []*computedValue
+	timeFormat     string
+	timeLocation   *time.Location
+	fieldTypes     map[string]string
+	rawTags        map[string]bool
+	tagIntFormat   string
+	tagTimeFormat  string
+	defaults       map[string]interface{}
+	required       []string
+	onMissing      string
+	onDelete       string
+	updateLookup   bool
+	explode        string
+	explodeTime    string
+	explodeIndex   string
+	tombstone      string
+	filters        []*docFilter
+	plug           mongofluxdplug.Plugin
 }
 
 type InfluxCtx struct {
-	m        map[string]client.BatchPoints
-	c        client.Client
-	dbs      map[string]bool
-	measures map[string]*InfluxMeasure
-	config   *configOptions
-	lastTs   primitive.Timestamp
-	client   *mongo.Client
-	tokens   bson.M
+	m           map[string]*Batch
+	sink        Sink
+	retry       *backoff
+	dbs         map[string]bool
+	measures    map[string][]*InfluxMeasure
+	patterns    []*InfluxMeasure
+	matched     map[string][]*InfluxMeasure
+	config      *configOptions
+	client      *mongo.Client
+	checkpoints *checkpointer
+	lookups     []*pendingLookup
+	targets     []*Batch
+	fetching    bool
 }
 
 type InfluxDataMap struct {
 	op        *gtm.Op
+	verbose   bool
 	tags      map[string]string
 	fields    map[string]interface{}
 	timefield bool
@@ -174,45 +266,503 @@ func (im *InfluxMeasure) parseView(view string) error {
 	return nil
 }
 
-func (ctx *InfluxCtx) saveTs() (err error) {
-	if ctx.config.Resume && ctx.lastTs.T > 0 {
-		if err = ctx.writeBatch(); err != nil {
-			return err
+func newDocFilter(fs *filterSettings) (*docFilter, error) {
+	f := &docFilter{
+		field:    fs.Field,
+		operator: strings.ToLower(fs.Operator),
+		values:   fs.Values,
+		exists:   true,
+		optional: fs.Optional,
+	}
+	if f.field == "" {
+		return nil, fmt.Errorf("filter field is required")
+	}
+	switch f.operator {
+	case "eq", "ne", "gt", "lt":
+		if len(f.values) != 1 {
+			return nil, fmt.Errorf("filter operator %s on field %s requires exactly one value", f.operator, f.field)
+		}
+	case "in", "nin":
+		if len(f.values) == 0 {
+			return nil, fmt.Errorf("filter operator %s on field %s requires at least one value", f.operator, f.field)
 		}
-		if ctx.config.ResumeStrategy == tokenResumeStrategy {
-			err = saveTokens(ctx.client, ctx.tokens, ctx.config)
-			if err == nil {
-				ctx.tokens = bson.M{}
+	case "regex":
+		if len(f.values) == 0 {
+			return nil, fmt.Errorf("filter operator %s on field %s requires at least one value", f.operator, f.field)
+		}
+		for _, v := range f.values {
+			pattern, ok := v.(string)
+			if !ok {
+				return nil, fmt.Errorf("filter regex on field %s must be a string, got %T", f.field, v)
 			}
-		} else {
-			err = saveTimestamp(ctx.client, ctx.lastTs, ctx.config)
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				return nil, err
+			}
+			f.regexps = append(f.regexps, re)
+		}
+	case "exists":
+		if f.optional {
+			return nil, fmt.Errorf("filter operator exists on field %s cannot be optional", f.field)
+		}
+		if len(f.values) > 1 {
+			return nil, fmt.Errorf("filter operator exists on field %s takes at most one value", f.field)
+		}
+		if len(f.values) == 1 {
+			b, ok := f.values[0].(bool)
+			if !ok {
+				return nil, fmt.Errorf("filter exists on field %s must be a boolean, got %T", f.field, f.values[0])
+			}
+			f.exists = b
+		}
+	default:
+		return nil, fmt.Errorf("unsupported filter operator %q on field %s", fs.Operator, f.field)
+	}
+	return f, nil
+}
+
+// lookupPath returns the value at a dotted path such as meta.from within doc
+func lookupPath(doc map[string]interface{}, path string) (interface{}, bool) {
+	if v, ok := doc[path]; ok {
+		return v, true
+	}
+	if isSelector(path) {
+		if s, err := parseSelector(path, ""); err == nil {
+			if matches := s.resolve(doc); len(matches) > 0 {
+				return matches[0].value, true
+			}
+		}
+		return nil, false
+	}
+	var cur interface{} = doc
+	for _, key := range strings.Split(path, ".") {
+		m, ok := cur.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if cur, ok = m[key]; !ok {
+			return nil, false
+		}
+	}
+	return cur, true
+}
+
+// setPath stores v at a dotted path within doc, copying any nested maps along
+// the way so that the original document is left untouched
+func setPath(doc map[string]interface{}, path string, v interface{}) {
+	keys := strings.Split(path, ".")
+	cur := doc
+	for _, key := range keys[:len(keys)-1] {
+		next := make(map[string]interface{})
+		if child, ok := cur[key].(map[string]interface{}); ok {
+			for ck, cv := range child {
+				next[ck] = cv
+			}
+		}
+		cur[key] = next
+		cur = next
+	}
+	cur[keys[len(keys)-1]] = v
+}
+
+// withDefaults returns op with the measurement defaults filled in for any
+// missing document keys. The op is copied if any default applies.
+func (im *InfluxMeasure) withDefaults(op *gtm.Op) *gtm.Op {
+	var data map[string]interface{}
+	for k, v := range im.defaults {
+		if _, found := lookupPath(op.Data, k); found {
+			continue
+		}
+		if data == nil {
+			data = make(map[string]interface{}, len(op.Data)+len(im.defaults))
+			for dk, dv := range op.Data {
+				data[dk] = dv
+			}
+		}
+		setPath(data, k, v)
+	}
+	if data == nil {
+		return op
+	}
+	withDefaults := *op
+	withDefaults.Data = data
+	return &withDefaults
+}
+
+func toFloat(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case int:
+		return float64(n), true
+	case int32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case uint32:
+		return float64(n), true
+	case uint64:
+		return float64(n), true
+	case float32:
+		return float64(n), true
+	case float64:
+		return n, true
+	default:
+		return 0, false
+	}
+}
+
+// compareValues orders a document value against a configured value. The
+// second return value is false when the two values cannot be compared.
+func compareValues(a, b interface{}) (int, bool) {
+	if fa, ok := toFloat(a); ok {
+		fb, ok := toFloat(b)
+		if !ok {
+			return 0, false
+		}
+		switch {
+		case fa < fb:
+			return -1, true
+		case fa > fb:
+			return 1, true
+		default:
+			return 0, true
+		}
+	}
+	switch av := a.(type) {
+	case string:
+		if bv, ok := b.(string); ok {
+			return strings.Compare(av, bv), true
+		}
+	case bool:
+		if bv, ok := b.(bool); ok && av == bv {
+			return 0, true
+		} else if ok {
+			return 1, true
+		}
+	case time.Time:
+		if bv, ok := b.(time.Time); ok {
+			switch {
+			case av.Before(bv):
+				return -1, true
+			case av.After(bv):
+				return 1, true
+			default:
+				return 0, true
+			}
+		}
+	case primitive.ObjectID:
+		if bv, ok := b.(string); ok {
+			return strings.Compare(av.Hex(), bv), true
+		}
+	}
+	return 0, false
+}
+
+func (f *docFilter) equalsAny(v interface{}) bool {
+	for _, fv := range f.values {
+		if c, ok := compareValues(v, fv); ok && c == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *docFilter) matches(doc map[string]interface{}) bool {
+	v, found := lookupPath(doc, f.field)
+	switch f.operator {
+	case "exists":
+		return found == f.exists
+	case "ne", "nin":
+		return !found || !f.equalsAny(v)
+	}
+	if !found {
+		return f.optional
+	}
+	switch f.operator {
+	case "eq", "in":
+		return f.equalsAny(v)
+	case "gt":
+		c, ok := compareValues(v, f.values[0])
+		return ok && c > 0
+	case "lt":
+		c, ok := compareValues(v, f.values[0])
+		return ok && c < 0
+	case "regex":
+		s, ok := v.(string)
+		if !ok {
+			return false
+		}
+		for _, re := range f.regexps {
+			if re.MatchString(s) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// accepts reports whether the document passes every filter of the measurement
+func (im *InfluxMeasure) accepts(doc map[string]interface{}) bool {
+	for _, f := range im.filters {
+		if !f.matches(doc) {
+			return false
+		}
+	}
+	return true
+}
+
+// parseFieldType reads a field-types entry such as finality:float. The name may
+// refer to the document key or to the output name of a configured field.
+func (im *InfluxMeasure) parseFieldType(spec string) error {
+	parts := strings.SplitN(spec, ":", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return fmt.Errorf("field type %q must be in the form name:type", spec)
+	}
+	name, kind := parts[0], strings.ToLower(parts[1])
+	switch kind {
+	case "float", "string":
+	case "int", "integer":
+		kind = "int"
+	case "bool", "boolean":
+		kind = "bool"
+	case "uint", "unsigned":
+		kind = "unsigned"
+	case "rfc3339", "unix", "unix_ms", "unix_us", "unix_ns", "hex", "base64":
+	default:
+		return fmt.Errorf("unsupported field type %q for field %s", parts[1], name)
+	}
+	if _, ok := im.fields[name]; !ok {
+		for k, out := range im.fields {
+			if out == name {
+				name = k
+				break
+			}
+		}
+		for _, s := range im.fieldSelectors {
+			if s.name == name {
+				name = s.spec
+				break
+			}
+		}
+	}
+	im.fieldTypes[name] = kind
+	return nil
+}
+
+func parseDecimal(d primitive.Decimal128) (float64, error) {
+	return strconv.ParseFloat(d.String(), 64)
+}
+
+// coerceField converts a document value to the InfluxDB field type kind
+func coerceField(v interface{}, kind string) (interface{}, error) {
+	switch kind {
+	case "unsigned", "rfc3339", "unix", "unix_ms", "unix_us", "unix_ns", "hex", "base64":
+		return coerceBSON(v, kind)
+	case "float":
+		if f, ok := toFloat(v); ok {
+			return f, nil
+		}
+		if i, ok := toInt(v); ok {
+			return float64(i), nil
+		}
+		switch vt := v.(type) {
+		case primitive.Decimal128:
+			return parseDecimal(vt)
+		case string:
+			return strconv.ParseFloat(strings.TrimSpace(vt), 64)
+		}
+	case "int":
+		if i, ok := toInt(v); ok {
+			return i, nil
+		}
+		switch v.(type) {
+		case float32, float64, primitive.Decimal128, string:
+			var f float64
+			var err error
+			switch vt := v.(type) {
+			case primitive.Decimal128:
+				f, err = parseDecimal(vt)
+			case string:
+				if i, err := strconv.ParseInt(strings.TrimSpace(vt), 10, 64); err == nil {
+					return i, nil
+				}
+				f, err = strconv.ParseFloat(strings.TrimSpace(vt), 64)
+			default:
+				f, _ = toFloat(vt)
+			}
+			if err != nil {
+				return nil, err
+			}
+			if f != float64(int64(f)) {
+				return nil, fmt.Errorf("value %v is not a whole number", v)
+			}
+			return int64(f), nil
+		}
+	case "string":
+		switch vt := v.(type) {
+		case string:
+			return vt, nil
+		case int:
+			return strconv.Itoa(vt), nil
+		case int32:
+			return strconv.FormatInt(int64(vt), 10), nil
+		case int64:
+			return strconv.FormatInt(vt, 10), nil
+		case float32:
+			return strconv.FormatFloat(float64(vt), 'f', -1, 32), nil
+		case float64:
+			return strconv.FormatFloat(vt, 'f', -1, 64), nil
+		case bool:
+			return strconv.FormatBool(vt), nil
+		case primitive.Decimal128:
+			return vt.String(), nil
+		case primitive.ObjectID:
+			return vt.Hex(), nil
+		case time.Time, primitive.DateTime:
+			return coerceBSON(v, "rfc3339")
+		case primitive.Binary, []byte:
+			return coerceBSON(v, "hex")
+		}
+		if i, ok := toInt(v); ok {
+			return strconv.FormatInt(i, 10), nil
+		}
+		if u, ok := v.(uint64); ok {
+			return strconv.FormatUint(u, 10), nil
+		}
+	case "bool":
+		switch vt := v.(type) {
+		case bool:
+			return vt, nil
+		case string:
+			return strconv.ParseBool(strings.TrimSpace(vt))
+		default:
+			if f, ok := toFloat(v); ok && (f == 0 || f == 1) {
+				return f == 1, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("cannot convert %T value %v to %s", v, v, kind)
+}
+
+// missingFields returns the required keys which are absent from doc
+func (im *InfluxMeasure) missingFields(doc map[string]interface{}) (missing []string) {
+	for _, k := range im.required {
+		if _, found := lookupPath(doc, k); !found {
+			missing = append(missing, k)
 		}
-		ctx.lastTs = primitive.Timestamp{}
 	}
 	return
 }
 
+func (ctx *InfluxCtx) onMissing(op *gtm.Op, measure *InfluxMeasure, missing []string) error {
+	err := fmt.Errorf("required fields %s not found in document %v of namespace %s",
+		strings.Join(missing, ", "), op.Id, op.Namespace)
+	switch measure.onMissing {
+	case onMissingSkip:
+		atomic.AddInt64(&counters.skipped, 1)
+		if ctx.config.Verbose {
+			infoLog.Printf("Skipping: %s\n", err)
+		}
+		return nil
+	case onMissingDeadLetter:
+		if dlErr := ctx.deadLetter(op, stageMap, &measureError{keys: []string{measure.key}, err: err}); dlErr != nil {
+			return dlErr
+		}
+		atomic.AddInt64(&counters.deadLettered, 1)
+		return nil
+	default:
+		return err
+	}
+}
+
+// load returns a snapshot of the counters
+func (c *docCounters) load() docCounters {
+	return docCounters{
+		filtered:     atomic.LoadInt64(&c.filtered),
+		skipped:      atomic.LoadInt64(&c.skipped),
+		deadLettered: atomic.LoadInt64(&c.deadLettered),
+		failed:       atomic.LoadInt64(&c.failed),
+		rejected:     atomic.LoadInt64(&c.rejected),
+	}
+}
+
+func (c docCounters) log() {
+	infoLog.Printf("documents filtered: %d, skipped: %d, dead lettered: %d, failed: %d, points rejected: %d\n",
+		c.filtered, c.skipped, c.deadLettered, c.failed, c.rejected)
+}
+
+func logCounters() {
+	counters.load().log()
+}
+
+// logChangedCounters logs the counters unless they equal logged and returns
+// the counters now logged
+func logChangedCounters(logged docCounters) docCounters {
+	if c := counters.load(); c != logged {
+		c.log()
+		return c
+	}
+	return logged
+}
+
 func (ctx *InfluxCtx) setupMeasurements() error {
 	mss := ctx.config.Measurement
 	if len(mss) > 0 {
+		keys := make(map[string]bool)
+		var targets []*Batch
 		for _, ms := range mss {
+			pattern, err := ms.pattern()
+			if err != nil {
+				return err
+			}
 			im := &InfluxMeasure{
-				ns:        ms.Namespace,
-				timefield: ms.Timefield,
-				retention: ms.Retention,
-				precision: ms.Precision,
-				measure:   ms.Measure,
-				database:  ms.Database,
-				plug:      ms.plug,
-				tags:      make(map[string]string),
-				fields:    make(map[string]string),
+				key:           ms.key(),
+				pattern:       pattern,
+				ns:            ms.name(),
+				timefield:     ms.Timefield,
+				retention:     ms.Retention,
+				precision:     ms.Precision,
+				measure:       ms.Measure,
+				database:      ms.Database,
+				defaults:      ms.Defaults,
+				required:      ms.Required,
+				onMissing:     strings.ToLower(ms.OnMissing),
+				onDelete:      strings.ToLower(ms.OnDelete),
+				updateLookup:  ms.UpdateLookup,
+				tagIntFormat:  ms.TagIntFormat,
+				tagTimeFormat: ms.TagTimeFormat,
+				explode:       ms.Explode,
+				explodeTime:   ms.ExplodeTime,
+				explodeIndex:  ms.ExplodeIndex,
+				tombstone:     ms.Tombstone,
+				plug:          ms.plug,
+				tags:          make(map[string]string),
+				fields:        make(map[string]string),
+				fieldTypes:    make(map[string]string),
+			}
+			if ms.Bucket != "" && ctx.config.sinkName() == influxV2SinkName {
+				im.database = ms.Bucket
 			}
 			if ms.View != "" {
+				if pattern != nil {
+					return fmt.Errorf("view %s cannot be used with namespace pattern %s", ms.View, pattern.src)
+				}
 				im.ns = ms.View
 				if err := im.parseView(ms.View); err != nil {
 					return err
 				}
 			}
+			if pattern != nil {
+				// the database and measurement default to those of each namespace matched
+				if im.database == "" {
+					if pattern.db == "" {
+						return fmt.Errorf("database is required for namespace pattern %s", pattern.src)
+					}
+					im.database = pattern.db
+				}
+				if im.measure == "" {
+					im.measure = "{{ .Op.Collection }}"
+				}
+			}
 			if im.database == "" {
 				im.database = strings.SplitN(im.ns, ".", 2)[0]
 			}
@@ -221,7 +771,7 @@ func (ctx *InfluxCtx) setupMeasurements() error {
 			} else {
 				if strings.Contains(im.measure, "{{") {
 					// detect and create go text/template for measure name
-					tpl, err := template.New(im.ns).Parse(im.measure)
+					tpl, err := template.New(im.ns).Funcs(measureFuncs).Parse(im.measure)
 					if err != nil {
 						return err
 					}
@@ -231,9 +781,23 @@ func (ctx *InfluxCtx) setupMeasurements() error {
 			if im.precision == "" {
 				im.precision = "s"
 			}
+			if pv, ok := ctx.sink.(precisionValidator); ok && !pv.ValidPrecision(im.precision) {
+				return fmt.Errorf("precision %s is not supported by the configured sink", im.precision)
+			}
+			targets = append(targets, &Batch{
+				Database:        im.database,
+				RetentionPolicy: im.retention,
+				Precision:       im.precision,
+			})
 			for _, tag := range ms.Tags {
 				names := strings.SplitN(tag, ":", 2)
-				if len(names) < 2 {
+				if isSelector(names[0]) {
+					s, err := parseSelector(names[0], strings.Join(names[1:], ""))
+					if err != nil {
+						return err
+					}
+					im.tagSelectors = append(im.tagSelectors, s)
+				} else if len(names) < 2 {
 					im.tags[names[0]] = names[0]
 				} else {
 					im.tags[names[0]] = names[1]
@@ -241,22 +805,112 @@ func (ctx *InfluxCtx) setupMeasurements() error {
 			}
 			for _, field := range ms.Fields {
 				names := strings.SplitN(field, ":", 2)
-				if len(names) < 2 {
+				if isSelector(names[0]) {
+					s, err := parseSelector(names[0], strings.Join(names[1:], ""))
+					if err != nil {
+						return err
+					}
+					im.fieldSelectors = append(im.fieldSelectors, s)
+				} else if len(names) < 2 {
 					im.fields[names[0]] = names[0]
 				} else {
 					im.fields[names[0]] = names[1]
 				}
 			}
+			switch im.onMissing {
+			case "":
+				im.onMissing = onMissingError
+			case onMissingSkip, onMissingError, onMissingDeadLetter:
+			default:
+				return fmt.Errorf("unsupported on-missing policy %q for namespace %s", ms.OnMissing, ms.name())
+			}
+			switch im.onDelete {
+			case "":
+				im.onDelete = onDeleteIgnore
+			case onDeleteIgnore, onDeleteTombstone:
+			case onDeleteDelete:
+				if _, ok := ctx.sink.(pointDeleter); !ok {
+					return fmt.Errorf("on-delete %s for namespace %s is not supported by the configured sink", im.onDelete, ms.name())
+				}
+			default:
+				return fmt.Errorf("unsupported on-delete policy %q for namespace %s", ms.OnDelete, ms.name())
+			}
+			if im.onDelete != onDeleteIgnore {
+				if keys[im.key] {
+					return fmt.Errorf("measurements of namespace %s remember points under the same key %s, set id to tell them apart", ms.name(), im.key)
+				}
+				keys[im.key] = true
+			}
+			if im.tombstone == "" {
+				im.tombstone = tombstoneFieldDefault
+			}
+			if im.explodeIndex == "" {
+				im.explodeIndex = explodeIndexDefault
+			} else if im.explodeIndex == explodeIndexNone {
+				im.explodeIndex = ""
+			}
+			if im.plug == nil && im.timefield != "" {
+				// copied so that the settings stay as configured for a reload
+				im.required = append(append([]string(nil), ms.Required...), im.timefield)
+			}
+			// nested time fields such as order.filledAt or legs[0].at are
+			// resolved as a path since flatmap drops time values
+			if isSelector(im.timefield) || strings.Contains(im.timefield, ".") {
+				s, err := parseSelector(im.timefield, "")
+				if err != nil {
+					return err
+				}
+				if s.wildcard {
+					return fmt.Errorf("time field %s must select a single value", im.timefield)
+				}
+				im.timeSelector = s
+			}
+			if err := im.setTimeFormat(ms.TimeFormat, ms.Timezone); err != nil {
+				return err
+			}
+			im.setRawTags(ms.RawTags)
+			if err := im.checkTagFormats(); err != nil {
+				return err
+			}
+			for _, ft := range ms.FieldTypes {
+				if err := im.parseFieldType(ft); err != nil {
+					return err
+				}
+			}
+			for _, fs := range ms.Filter {
+				f, err := newDocFilter(fs)
+				if err != nil {
+					return err
+				}
+				im.filters = append(im.filters, f)
+			}
+			if im.computedTags, err = parseComputed(ms.name(), "computed tag", ms.ComputedTags); err != nil {
+				return err
+			}
+			if im.computedFields, err = parseComputed(ms.name(), "computed field", ms.ComputedFields); err != nil {
+				return err
+			}
+			if err := im.checkMeasureTemplate(); err != nil {
+				return err
+			}
 			if im.plug == nil {
-				if len(im.fields) == 0 {
+				if len(im.fields) == 0 && len(im.fieldSelectors) == 0 && len(im.computedFields) == 0 {
 					return fmt.Errorf("at least one field is required per measurement")
 				}
 			}
-			ctx.measures[ms.Namespace] = im
+			if pattern != nil {
+				ctx.patterns = append(ctx.patterns, im)
+				continue
+			}
+			ctx.measures[ms.Namespace] = append(ctx.measures[ms.Namespace], im)
 			if ms.View != "" {
-				ctx.measures[ms.View] = im
+				ctx.measures[ms.View] = append(ctx.measures[ms.View], im)
 			}
 		}
+		ctx.targets = targets
+		if ts, ok := ctx.sink.(targetSetter); ok {
+			return ts.CheckTargets(targets)
+		}
 		return nil
 	} else {
 		return fmt.Errorf("At least one measurement is required")
@@ -266,47 +920,65 @@ func (ctx *InfluxCtx) setupMeasurements() error {
 func (ctx *InfluxCtx) createDatabase(db string) error {
 	if ctx.config.InfluxAutoCreateDB {
 		if ctx.dbs[db] == false {
-			q := client.NewQuery(fmt.Sprintf(`CREATE DATABASE "%s"`, db), "", "")
-			if response, err := ctx.c.Query(q); err != nil || response.Error() != nil {
-				if err != nil {
-					return err
-				} else {
-					return response.Error()
-				}
-			} else {
-				ctx.dbs[db] = true
+			if err := ctx.sink.EnsureDatabase(db); err != nil {
+				return err
 			}
+			ctx.dbs[db] = true
 		}
 	}
 	return nil
 }
 
-func (ctx *InfluxCtx) setupDatabase(op *gtm.Op) error {
-	ns := op.Namespace
-	if _, found := ctx.m[ns]; found == false {
-		measure := ctx.measures[ns]
-		bp, err := client.NewBatchPoints(client.BatchPointsConfig{
-			Database:        measure.database,
-			RetentionPolicy: measure.retention,
-			Precision:       measure.precision,
-		})
-		if err != nil {
-			return err
-		}
-		ctx.m[ns] = bp
-		if err := ctx.createDatabase(measure.database); err != nil {
-			return err
-		}
+// setupDatabase returns the batch for the points of the measurement. Each
+// measurement is batched on its own so that points rejected by InfluxDB only
+// affect the measurement which produced them.
+func (ctx *InfluxCtx) setupDatabase(measure *InfluxMeasure) (*Batch, error) {
+	key := strings.Join([]string{measure.key, measure.database, measure.retention, measure.precision}, "\x00")
+	if bp, found := ctx.m[key]; found {
+		return bp, nil
 	}
-	return nil
+	if err := ctx.createDatabase(measure.database); err != nil {
+		return nil, err
+	}
+	bp := &Batch{
+		Database:        measure.database,
+		RetentionPolicy: measure.retention,
+		Precision:       measure.precision,
+		measure:         measure.key,
+	}
+	ctx.m[key] = bp
+	return bp, nil
 }
 
+// writeBatch writes every pending batch, retrying with backoff. Batches which
+// cannot be written are kept for the next flush unless dead lettering is
+// enabled, and their ops stay held so that the checkpoint never moves past
+// unwritten points.
 func (ctx *InfluxCtx) writeBatch() (err error) {
 	points := 0
-	for _, bp := range ctx.m {
-		points += len(bp.Points())
-		if err = ctx.c.Write(bp); err != nil {
-			break
+	for key, bp := range ctx.m {
+		attempts, werr := ctx.writeWithRetry(bp)
+		if werr != nil && isPointError(werr) {
+			werr = ctx.isolate(bp, werr)
+		}
+		if werr == nil {
+			points += len(bp.Points)
+			if rerr := ctx.saveRemembered(bp); rerr != nil && err == nil {
+				err = rerr
+			}
+			ctx.checkpoints.releaseBatch(bp)
+			delete(ctx.m, key)
+			continue
+		}
+		werr = fmt.Errorf("Unable to write %d points to %s after %d attempts: %s",
+			len(bp.Points), bp.Database, attempts, werr)
+		if err == nil {
+			err = werr
+		}
+		if ctx.config.DeadLetter {
+			ctx.deadLetterBatch(bp, werr)
+			ctx.checkpoints.releaseBatch(bp)
+			delete(ctx.m, key)
 		}
 	}
 	if ctx.config.Verbose {
@@ -314,16 +986,27 @@ func (ctx *InfluxCtx) writeBatch() (err error) {
 			infoLog.Printf("%d points flushed\n", points)
 		}
 	}
-	ctx.m = make(map[string]client.BatchPoints)
 	return
 }
 
-func (m *InfluxDataMap) istagtype(v interface{}) bool {
-	switch v.(type) {
-	case string:
-		return true
-	default:
-		return false
+func (ctx *InfluxCtx) deadLetterBatch(bp *Batch, cause error) {
+	if !ctx.config.DeadLetter {
+		return
+	}
+	if bp.measure != "" {
+		cause = &measureError{keys: []string{bp.measure}, err: cause}
+	}
+	seen := make(map[*gtm.Op]bool)
+	for _, op := range bp.ops {
+		if seen[op] {
+			continue
+		}
+		seen[op] = true
+		if err := ctx.deadLetter(op, stageWrite, cause); err != nil {
+			errorLog.Printf("Unable to dead letter document %v of namespace %s: %s\n", op.Id, op.Namespace, err)
+		} else {
+			atomic.AddInt64(&counters.deadLettered, 1)
+		}
 	}
 }
 
@@ -337,6 +1020,8 @@ func (m *InfluxDataMap) isfieldtype(v interface{}) bool {
 		return true
 	case int64:
 		return true
+	case uint64:
+		return true
 	case float32:
 		return true
 	case float64:
@@ -353,12 +1038,13 @@ func (m *InfluxDataMap) flatmap(prefix string, e map[string]interface{}) map[str
 	for k, v := range e {
 		switch child := v.(type) {
 		case map[string]interface{}:
-			nm := m.flatmap("", child)
+			nm := m.flatmap(prefix+k+".", child)
 			for nk, nv := range nm {
-				o[prefix+k+"."+nk] = nv
+				o[nk] = nv
 			}
 		default:
-			if m.isfieldtype(v) {
+			_, typed := m.measure.fieldTypes[prefix+k]
+			if typed || m.measure.maps(prefix+k) || m.isfieldtype(v) {
 				o[prefix+k] = v
 			}
 		}
@@ -370,29 +1056,97 @@ func (m *InfluxDataMap) unsupportedType(op *gtm.Op, k string, v interface{}, kin
 	errorLog.Printf("Unsupported type %T for %s %s in namespace %s\n", v, kind, k, op.Namespace)
 }
 
+func (m *InfluxDataMap) loadTag(k, name string, v interface{}) {
+	if s, ok := m.measure.tagString(k, v); ok {
+		m.tags[name] = s
+	} else {
+		m.unsupportedType(m.op, k, v, "tag")
+	}
+}
+
+func (m *InfluxDataMap) loadField(k, name string, v interface{}) {
+	kind, typed := m.measure.fieldTypes[k]
+	if !typed {
+		kind = bsonFieldKind(v)
+	}
+	if kind != "" {
+		cv, err := coerceField(v, kind)
+		if err != nil {
+			errorLog.Printf("Unable to convert field %s to %s in namespace %s: %s\n", k, kind, m.op.Namespace, err)
+			return
+		}
+		if m.verbose && isLossy(v, cv, kind) {
+			infoLog.Printf("Lossy conversion of field %s in namespace %s from %T %v to %s %v\n", k, m.op.Namespace, v, v, kind, cv)
+		}
+		v = cv
+	}
+	if m.isfieldtype(v) {
+		m.fields[name] = v
+	} else {
+		m.unsupportedType(m.op, k, v, "field")
+	}
+}
+
+// maps reports whether k is configured as a tag or field
+func (im *InfluxMeasure) maps(k string) bool {
+	_, tag := im.tags[k]
+	_, field := im.fields[k]
+	return tag || field
+}
+
 func (m *InfluxDataMap) loadKV(k string, v interface{}) {
 	if name, ok := m.measure.tags[k]; ok {
-		if m.istagtype(v) {
-			m.tags[name] = v.(string)
-		} else {
-			m.unsupportedType(m.op, k, v, "tag")
-		}
+		m.loadTag(k, name, v)
 	} else if name, ok := m.measure.fields[k]; ok {
-		if m.isfieldtype(v) {
-			m.fields[name] = v
-		} else {
-			m.unsupportedType(m.op, k, v, "field")
+		m.loadField(k, name, v)
+	}
+}
+
+// loadSelected loads the tags and fields configured as path selectors.
+// Wildcards skip nested documents and arrays rather than reporting them.
+func (m *InfluxDataMap) loadSelected() {
+	for _, s := range m.measure.tagSelectors {
+		for _, match := range s.resolve(m.op.Data) {
+			if !s.wildcard || !isContainer(match.value) {
+				m.loadTag(s.spec, s.outputName(match), match.value)
+			}
+		}
+	}
+	for _, s := range m.measure.fieldSelectors {
+		for _, match := range s.resolve(m.op.Data) {
+			if !s.wildcard || !isContainer(match.value) {
+				m.loadField(s.spec, s.outputName(match), match.value)
+			}
 		}
 	}
 }
 
+func (m *InfluxDataMap) loadSelectedTime() error {
+	s := m.measure.timeSelector
+	if s == nil {
+		return nil
+	}
+	matches := s.resolve(m.op.Data)
+	if len(matches) == 0 {
+		return fmt.Errorf("time field %s not found in document", s.spec)
+	}
+	t, err := m.measure.pointTime(matches[0].value)
+	if err != nil {
+		return fmt.Errorf("time field %s %s", s.spec, err)
+	}
+	m.t = t
+	m.timefield = true
+	return nil
+}
+
 func (m *InfluxDataMap) resolveName(tags map[string]string, fields, doc map[string]interface{}) error {
 	if m.nameTpl != nil {
 		var b bytes.Buffer
-		env := map[string]interface{}{
-			"Tags":   tags,
-			"Fields": fields,
-			"Doc":    doc,
+		env := &templateEnv{
+			Tags:   tags,
+			Fields: fields,
+			Doc:    doc,
+			Op:     newTemplateOp(m.op, m.t),
 		}
 		if err := m.nameTpl.Execute(&b, env); err != nil {
 			return err
@@ -410,7 +1164,7 @@ func (m *InfluxDataMap) loadData() error {
 		m.timefield = true
 	}
 	for k, v := range m.op.Data {
-		if k == "_id" {
+		if k == "_id" && !m.measure.maps(k) {
 			continue
 		}
 		switch vt := v.(type) {
@@ -418,11 +1172,15 @@ func (m *InfluxDataMap) loadData() error {
 			if m.measure.timefield == k {
 				m.t = vt.UTC()
 				m.timefield = true
+			} else {
+				m.loadKV(k, v)
 			}
 		case primitive.Timestamp:
 			if m.measure.timefield == k {
 				m.t = TimestampTime(vt)
 				m.timefield = true
+			} else {
+				m.loadKV(k, v)
 			}
 		case map[string]interface{}:
 			flat := m.flatmap(k+".", vt)
@@ -430,9 +1188,25 @@ func (m *InfluxDataMap) loadData() error {
 				m.loadKV(fk, fv)
 			}
 		default:
-			m.loadKV(k, v)
+			if m.measure.timefield == k && m.measure.timeFormat != "" {
+				t, err := m.measure.pointTime(v)
+				if err != nil {
+					return fmt.Errorf("time field %s %s", k, err)
+				}
+				m.t = t
+				m.timefield = true
+			} else {
+				m.loadKV(k, v)
+			}
 		}
 	}
+	m.loadSelected()
+	if err := m.loadSelectedTime(); err != nil {
+		return err
+	}
+	if err := m.loadElementTime(); err != nil {
+		return err
+	}
 	if m.timefield == false {
 		if tf, ok := m.op.Data[m.measure.timefield]; ok {
 			return fmt.Errorf("time field %s had type %T, but expected %T", m.measure.timefield, tf, m.t)
@@ -466,70 +1240,151 @@ func (ctx *InfluxCtx) lookupInView(orig *gtm.Op, view *dbcol) (op *gtm.Op, err e
 	return
 }
 
-func (ctx *InfluxCtx) addPoint(op *gtm.Op) error {
-	measure := ctx.measures[op.Namespace]
-	if measure != nil {
-		if measure.view != nil && op.IsSourceOplog() {
-			var err error
-			op, err = ctx.lookupInView(op, measure.view)
-			if err != nil {
-				return err
-			}
-		}
-		if err := ctx.setupDatabase(op); err != nil {
-			return err
-		}
-		bp := ctx.m[op.Namespace]
+// batchPoint adds pt to the batch and holds the op in the checkpoint until
+// the batch is written
+func (ctx *InfluxCtx) batchPoint(bp *Batch, pt *client.Point, op *gtm.Op) {
+	if n := len(bp.ops); n == 0 || bp.ops[n-1] != op {
+		ctx.checkpoints.hold(op)
+	}
+	bp.add(pt, op)
+}
+
+// mapPoints runs the plugin or the declarative mapping of the measurement
+func (ctx *InfluxCtx) mapPoints(op *gtm.Op, measure *InfluxMeasure) ([]*client.Point, error) {
+	var points []*client.Point
+	if measure.plug != nil {
 		mapper := &InfluxDataMap{
 			op:      op,
 			measure: measure,
 			name:    measure.measure,
 			nameTpl: measure.measureTpl,
 		}
-		if measure.plug != nil {
-			points, err := measure.plug(&mongofluxdplug.MongoDocument{
-				Data:       op.Data,
-				Namespace:  op.Namespace,
-				Database:   op.GetDatabase(),
-				Collection: op.GetCollection(),
-				Operation:  op.Operation,
-			})
+		pts, err := measure.plug.Map(pluginDocument(op))
+		if err != nil {
+			return nil, err
+		}
+		for _, pt := range pts {
+			mapper.t = pt.Timestamp
+			if err := mapper.resolveName(pt.Tags, pt.Fields, op.Data); err != nil {
+				return nil, err
+			}
+			pt, err := client.NewPoint(mapper.name, pt.Tags, pt.Fields, pt.Timestamp)
 			if err != nil {
-				return err
+				return nil, err
 			}
-			for _, pt := range points {
-				if err := mapper.resolveName(pt.Tags, pt.Fields, op.Data); err != nil {
-					return err
-				}
-				pt, err := client.NewPoint(mapper.name, pt.Tags, pt.Fields, pt.Timestamp)
-				if err != nil {
-					return err
-				}
-				bp.AddPoint(pt)
+			points = append(points, pt)
+		}
+	} else {
+		docs, err := measure.explodeDocs(op.Data)
+		if err != nil {
+			return nil, err
+		}
+		for i, doc := range docs {
+			docOp := *op
+			docOp.Data = doc
+			mapper := &InfluxDataMap{
+				op:      &docOp,
+				verbose: ctx.config.Verbose,
+				measure: measure,
+				name:    measure.measure,
+				nameTpl: measure.measureTpl,
 			}
-		} else {
 			if err := mapper.loadData(); err != nil {
-				return err
+				return nil, err
 			}
-			if err := mapper.resolveName(mapper.tags, mapper.fields, op.Data); err != nil {
-				return err
+			mapper.loadElementIndex(i)
+			mapper.loadComputed()
+			if err := mapper.resolveName(mapper.tags, mapper.fields, doc); err != nil {
+				return nil, err
 			}
 			pt, err := client.NewPoint(mapper.name, mapper.tags, mapper.fields, mapper.t)
 			if err != nil {
-				return err
+				return nil, err
 			}
-			bp.AddPoint(pt)
+			points = append(points, pt)
 		}
-		if op.IsSourceOplog() {
-			ctx.lastTs = op.Timestamp
-			if ctx.config.ResumeStrategy == tokenResumeStrategy {
-				ctx.tokens[op.ResumeToken.StreamID] = op.ResumeToken.ResumeToken
+	}
+	return points, nil
+}
+
+// addPoint maps the op with every measurement of its namespace. Each
+// measurement is mapped on its own and the measurements which failed are
+// returned in a *measureError.
+func (ctx *InfluxCtx) addPoint(op *gtm.Op) error {
+	return ctx.addPointTo(op, ctx.measuresFor(op.Namespace))
+}
+
+// addPointTo maps the op with the given measurements of its namespace
+func (ctx *InfluxCtx) addPointTo(op *gtm.Op, measures []*InfluxMeasure) error {
+	if !ctx.fetching && !op.IsDelete() {
+		for _, measure := range measures {
+			if measure.needsLookup(op) {
+				ctx.queueLookup(op, measures)
+				return nil
 			}
 		}
-		if len(bp.Points()) >= ctx.config.InfluxBufferSize {
-			if err := ctx.writeBatch(); err != nil {
-				return err
-			}
+	}
+	var failed *measureError
+	for _, measure := range measures {
+		var err error
+		if op.IsDelete() {
+			err = ctx.deletePoints(op, measure)
+		} else {
+			err = ctx.addMeasurePoints(op, measure)
+		}
+		if err == nil {
+			continue
+		}
+		if failed == nil {
+			failed = &measureError{err: err}
+		}
+		failed.keys = append(failed.keys, measure.key)
+	}
+	if failed != nil {
+		return failed
+	}
+	return nil
+}
+
+func (ctx *InfluxCtx) addMeasurePoints(op *gtm.Op, measure *InfluxMeasure) error {
+	orig := op
+	if measure.view != nil && op.IsSourceOplog() {
+		var err error
+		op, err = ctx.lookupInView(op, measure.view)
+		if err != nil {
+			return err
+		}
+	}
+	op = measure.withDefaults(op)
+	if !measure.accepts(op.Data) {
+		atomic.AddInt64(&counters.filtered, 1)
+		return nil
+	}
+	if missing := measure.missingFields(op.Data); len(missing) > 0 {
+		return ctx.onMissing(op, measure, missing)
+	}
+	points, err := ctx.mapPoints(op, measure)
+	if err == mongofluxdplug.ErrDrop {
+		atomic.AddInt64(&counters.filtered, 1)
+		return nil
+	} else if err != nil {
+		return err
+	}
+	bp, err := ctx.setupDatabase(measure)
+	if err != nil {
+		return err
+	}
+	for _, pt := range points {
+		ctx.batchPoint(bp, pt, orig)
+	}
+	if measure.onDelete != onDeleteIgnore {
+		bp.remember(orig, measure, points)
+	}
+	if len(bp.Points) >= ctx.config.InfluxBufferSize {
+		// write errors are not caused by this op, which is already batched
+		if err := ctx.writeBatch(); err != nil {
+			exitStatus = 1
+			errorLog.Println(err)
 		}
 	}
 	return nil
@@ -539,6 +1394,18 @@ func IsInsertOrUpdate(op *gtm.Op) bool {
 	return op.IsInsert() || op.IsUpdate()
 }
 
+// handledOps passes inserts and updates, and deletes in the namespaces of
+// measurements which map deletes
+func (config *configOptions) handledOps() gtm.OpFilter {
+	deletes := newNsMatcher(config.Measurement, func(ms *measureSettings) bool {
+		p := strings.ToLower(ms.OnDelete)
+		return p != "" && p != onDeleteIgnore
+	})
+	return func(op *gtm.Op) bool {
+		return IsInsertOrUpdate(op) || (op.IsDelete() && deletes.matches(op.Namespace))
+	}
+}
+
 func NotMongoFlux(op *gtm.Op) bool {
 	return op.GetDatabase() != Name
 }
@@ -586,28 +1453,13 @@ func saveTimestamp(client *mongo.Client, ts primitive.Timestamp, config *configO
 	return err
 }
 
-func (config *configOptions) onlyMeasured() gtm.OpFilter {
-	if config.ChangeStreams {
-		return func(op *gtm.Op) bool {
-			return true
-		}
-	}
-	measured := make(map[string]bool)
-	for _, m := range config.Measurement {
-		measured[m.Namespace] = true
-		if m.View != "" {
-			measured[m.View] = true
-		}
-	}
-	return func(op *gtm.Op) bool {
-		return measured[op.Namespace]
-	}
-}
-
 func (config *configOptions) ParseCommandLineFlags() *configOptions {
+	flag.StringVar(&config.Sink, "sink", "", "The output for points: influxdb, influxdb2, stdout or file. Defaults to influxdb2 when a token is set")
 	flag.StringVar(&config.InfluxURL, "influx-url", "", "InfluxDB connection URL")
 	flag.StringVar(&config.InfluxUser, "influx-user", "", "InfluxDB user name")
 	flag.StringVar(&config.InfluxPassword, "influx-password", "", "InfluxDB user password")
+	flag.StringVar(&config.InfluxOrg, "influx-org", "", "InfluxDB 2.x organization")
+	flag.StringVar(&config.InfluxToken, "influx-token", "", "InfluxDB 2.x API token")
 	flag.BoolVar(&config.InfluxSkipVerify, "influx-skip-verify", false, "Set true to skip https certificate validation for InfluxDB")
 	flag.BoolVar(&config.InfluxAutoCreateDB, "influx-auto-create-db", true, "Set false to disable automatic database creation on InfluxDB")
 	flag.StringVar(&config.InfluxPemFile, "influx-pem-file", "", "Path to a PEM file for secure connections to InfluxDB")
@@ -628,6 +1480,7 @@ func (config *configOptions) ParseCommandLineFlags() *configOptions {
 	flag.StringVar(&config.PluginPath, "plugin-path", "", "The file path to a .so file plugin")
 	flag.BoolVar(&config.DirectReads, "direct-reads", false, "Set to true to read directly from MongoDB collections")
 	flag.BoolVar(&config.ChangeStreams, "change-streams", false, "Set to true to enable change streams for MongoDB 3.6+")
+	flag.BoolVar(&config.DeadLetter, "dead-letter", false, "Set to true to save documents which fail mapping or writing to the mongofluxd.deadletter collection")
 	flag.BoolVar(&config.ExitAfterDirectReads, "exit-after-direct-reads", false, "Set to true to exit after direct reads are complete")
 	flag.Parse()
 	return config
@@ -640,39 +1493,69 @@ func (config *configOptions) LoadPlugin() *configOptions {
 		}
 		return config
 	}
+	if err := config.loadPlugins(config.Measurement); err != nil {
+		errorLog.Fatalln(err)
+	}
+	if config.Verbose {
+		infoLog.Printf("plugin <%s> loaded succesfully\n", config.PluginPath)
+	}
+	return config
+}
+
+// loadPlugins looks up the plugin symbols of the measurements and initializes
+// version 2 plugins. A plugin is only loaded once per process so a reload can
+// pick other symbols but does not see a rebuilt plugin.
+func (config *configOptions) loadPlugins(mss []*measureSettings) (err error) {
+	if config.PluginPath == "" {
+		return nil
+	}
 	p, err := plugin.Open(config.PluginPath)
 	if err != nil {
-		errorLog.Fatalf("Unable to load plugin <%s>: %s", config.PluginPath, err)
+		return fmt.Errorf("Unable to load plugin <%s>: %s", config.PluginPath, err)
 	}
-	for _, m := range config.Measurement {
+	defer func() {
+		if err != nil {
+			closePlugins(mss)
+		}
+	}()
+	for _, m := range mss {
 		if m.Symbol != "" {
 			f, err := p.Lookup(m.Symbol)
 			if err != nil {
-				errorLog.Fatalf("Unable to lookup symbol <%s> for plugin <%s>: %s", m.Symbol, config.PluginPath, err)
+				return fmt.Errorf("Unable to lookup symbol <%s> for plugin <%s>: %s", m.Symbol, config.PluginPath, err)
 			}
-			switch f.(type) {
+			switch f := f.(type) {
 			case func(*mongofluxdplug.MongoDocument) ([]*mongofluxdplug.InfluxPoint, error):
-				m.plug = f.(func(*mongofluxdplug.MongoDocument) ([]*mongofluxdplug.InfluxPoint, error))
+				m.plug = funcPlugin(f)
+			case func() mongofluxdplug.Plugin:
+				plug := f()
+				if err := plug.Init(m.PluginConfig); err != nil {
+					return fmt.Errorf("Unable to init plugin symbol <%s>: %s", m.Symbol, err)
+				}
+				m.plug = plug
 			default:
-				errorLog.Fatalf("Plugin symbol <%s> must be typed %T", m.Symbol, m.plug)
+				return fmt.Errorf("Plugin symbol <%s> must be typed %T or %T", m.Symbol,
+					(func(*mongofluxdplug.MongoDocument) ([]*mongofluxdplug.InfluxPoint, error))(nil),
+					(func() mongofluxdplug.Plugin)(nil))
 			}
 		}
 	}
-	if config.Verbose {
-		infoLog.Printf("plugin <%s> loaded succesfully\n", config.PluginPath)
-	}
-	return config
+	return nil
 }
 
 func (config *configOptions) LoadConfigFile() *configOptions {
 	if config.ConfigFile != "" {
 		var tomlConfig configOptions = configOptions{
 			GtmSettings:        GtmDefaultSettings(),
+			WriteRetry:         RetryDefaultSettings(),
 			InfluxAutoCreateDB: true,
 		}
 		if _, err := toml.DecodeFile(config.ConfigFile, &tomlConfig); err != nil {
 			panic(err)
 		}
+		if config.Sink == "" {
+			config.Sink = tomlConfig.Sink
+		}
 		if config.InfluxURL == "" {
 			config.InfluxURL = tomlConfig.InfluxURL
 		}
@@ -688,6 +1571,12 @@ func (config *configOptions) LoadConfigFile() *configOptions {
 		if config.InfluxPassword == "" {
 			config.InfluxPassword = tomlConfig.InfluxPassword
 		}
+		if config.InfluxOrg == "" {
+			config.InfluxOrg = tomlConfig.InfluxOrg
+		}
+		if config.InfluxToken == "" {
+			config.InfluxToken = tomlConfig.InfluxToken
+		}
 		if config.InfluxSkipVerify == false {
 			config.InfluxSkipVerify = tomlConfig.InfluxSkipVerify
 		}
@@ -723,6 +1612,9 @@ func (config *configOptions) LoadConfigFile() *configOptions {
 		if !config.ExitAfterDirectReads && tomlConfig.ExitAfterDirectReads {
 			config.ExitAfterDirectReads = true
 		}
+		if !config.DeadLetter && tomlConfig.DeadLetter {
+			config.DeadLetter = true
+		}
 		if !config.Resume && tomlConfig.Resume {
 			config.Resume = true
 		}
@@ -742,6 +1634,8 @@ func (config *configOptions) LoadConfigFile() *configOptions {
 			config.PluginPath = tomlConfig.PluginPath
 		}
 		config.GtmSettings = tomlConfig.GtmSettings
+		config.FileSink = tomlConfig.FileSink
+		config.WriteRetry = tomlConfig.WriteRetry
 		config.Measurement = tomlConfig.Measurement
 	}
 	return config
@@ -852,18 +1746,40 @@ func GtmDefaultSettings() gtmSettings {
 	}
 }
 
-func saveTimestampFromReplStatus(client *mongo.Client, config *configOptions) {
-	if rs, err := gtm.GetReplStatus(client); err == nil {
-		var ts primitive.Timestamp
-		if ts, err = rs.GetLastCommitted(); err == nil {
-			saveTimestamp(client, ts, config)
-		}
+func newInfluxCtx(config *configOptions, sink Sink, mongoClient *mongo.Client, cp *checkpointer) (*InfluxCtx, error) {
+	influx := &InfluxCtx{
+		checkpoints: cp,
+		sink:        sink,
+		m:           make(map[string]*Batch),
+		dbs:         make(map[string]bool),
+		measures:    make(map[string][]*InfluxMeasure),
+		matched:     make(map[string][]*InfluxMeasure),
+		config:      config,
+		client:      mongoClient,
+	}
+	var err error
+	if influx.retry, err = config.WriteRetry.backoff(); err != nil {
+		return nil, err
+	}
+	if err = influx.setupMeasurements(); err != nil {
+		return nil, err
+	}
+	return influx, nil
+}
+
+// applyTargets hands the targets of the measurements to the sink once the
+// context is used for writing
+func (ctx *InfluxCtx) applyTargets() error {
+	if ts, ok := ctx.sink.(targetSetter); ok {
+		return ts.SetTargets(ctx.targets)
 	}
+	return nil
 }
 
 func main() {
 	config := &configOptions{
 		GtmSettings: GtmDefaultSettings(),
+		WriteRetry:  RetryDefaultSettings(),
 	}
 	config.ParseCommandLineFlags()
 	if config.Version {
@@ -880,6 +1796,9 @@ func main() {
 	stopC := make(chan bool, 1)
 	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM, syscall.SIGKILL)
 	defer signal.Stop(sigs)
+	hups := make(chan os.Signal, 1)
+	signal.Notify(hups, syscall.SIGHUP)
+	defer signal.Stop(hups)
 
 	mongoClient, err := config.DialMongo()
 	if err != nil {
@@ -887,6 +1806,10 @@ func main() {
 			cleanMongoURL(config.MongoURL), err)
 	}
 
+	if args := flag.Args(); len(args) > 0 {
+		runCommand(config, mongoClient, args)
+	}
+
 	go func() {
 		<-sigs
 		stopC <- true
@@ -953,175 +1876,64 @@ func main() {
 		}
 	}
 
-	var filter gtm.OpFilter = nil
-	filterChain := []gtm.OpFilter{NotMongoFlux, config.onlyMeasured(), IsInsertOrUpdate}
-	filter = gtm.ChainOpFilters(filterChain...)
 	gtmBufferDuration, err := time.ParseDuration(config.GtmSettings.BufferDuration)
 	if err != nil {
 		errorLog.Fatalf("Unable to parse gtm buffer duration %s: %s", config.GtmSettings.BufferDuration, err)
 	}
-	httpConfig := client.HTTPConfig{
-		UserAgent:          fmt.Sprintf("%s v%s", Name, Version),
-		Addr:               config.InfluxURL,
-		Username:           config.InfluxUser,
-		Password:           config.InfluxPassword,
-		InsecureSkipVerify: config.InfluxSkipVerify,
-	}
-	if config.InfluxPemFile != "" {
-		tlsConfig, err := config.InfluxTLS()
-		if err != nil {
-			errorLog.Fatalf("Unable to configure TLS for InfluxDB: %s", err)
-		}
-		httpConfig.TLSConfig = tlsConfig
-	}
-	influxClient, err := client.NewHTTPClient(httpConfig)
+	sink, err := config.NewSink()
 	if err != nil {
-		errorLog.Fatalf("Unable to create InfluxDB client: %s", err)
+		errorLog.Fatalf("Unable to create sink: %s", err)
 	}
-	var directReadNs, changeStreamNs []string
+	var directReadNs []string
 	if config.DirectReads {
-		for _, m := range config.Measurement {
-			if m.View != "" {
-				directReadNs = append(directReadNs, m.View)
-			} else {
-				directReadNs = append(directReadNs, m.Namespace)
-			}
-		}
-	}
-	if config.ChangeStreams {
-		for _, m := range config.Measurement {
-			changeStreamNs = append(changeStreamNs, m.Namespace)
-		}
-	}
-	gtmCtx := gtm.Start(mongoClient, &gtm.Options{
-		After:               after,
-		Token:               token,
-		Log:                 infoLog,
-		NamespaceFilter:     filter,
-		OpLogDisabled:       len(changeStreamNs) > 0,
-		OpLogDatabaseName:   config.MongoOpLogDatabaseName,
-		OpLogCollectionName: config.MongoOpLogCollectionName,
-		ChannelSize:         config.GtmSettings.ChannelSize,
-		Ordering:            gtm.AnyOrder,
-		WorkerCount:         4,
-		BufferDuration:      gtmBufferDuration,
-		BufferSize:          config.GtmSettings.BufferSize,
-		DirectReadNs:        directReadNs,
-		ChangeStreamNs:      changeStreamNs,
-	})
-	var wg sync.WaitGroup
-	for i := 1; i <= config.InfluxClients; i++ {
-		wg.Add(1)
+		if directReadNs, err = config.directReadNamespaces(mongoClient); err != nil {
+			errorLog.Fatalf("Unable to list namespaces for direct reads: %s", err)
+		}
+	}
+	checkpoints := newCheckpointer(config, mongoClient)
+	if config.Resume || config.Verbose {
 		go func() {
-			defer wg.Done()
-			flusher := time.NewTicker(1 * time.Second)
-			defer flusher.Stop()
 			progress := time.NewTicker(10 * time.Second)
 			defer progress.Stop()
-			influx := &InfluxCtx{
-				c:        influxClient,
-				m:        make(map[string]client.BatchPoints),
-				dbs:      make(map[string]bool),
-				measures: make(map[string]*InfluxMeasure),
-				config:   config,
-				client:   mongoClient,
-				tokens:   bson.M{},
-			}
-			if err := influx.setupMeasurements(); err != nil {
-				errorLog.Fatalf("Configuration error: %s", err)
-			}
-			for {
-				select {
-				case <-progress.C:
-					if err := influx.saveTs(); err != nil {
-						exitStatus = 1
-						errorLog.Println(err)
-					}
-				case <-flusher.C:
-					if err := influx.writeBatch(); err != nil {
-						exitStatus = 1
-						errorLog.Println(err)
-					}
-				case err = <-gtmCtx.ErrC:
-					if err == nil {
-						break
-					}
+			var logged docCounters
+			for range progress.C {
+				if config.Verbose {
+					logged = logChangedCounters(logged)
+				}
+				if err := checkpoints.save(); err != nil {
 					exitStatus = 1
 					errorLog.Println(err)
-				case op, open := <-gtmCtx.OpC:
-					if op == nil {
-						if !open {
-							if err := influx.saveTs(); err != nil {
-								exitStatus = 1
-								errorLog.Println(err)
-							}
-							return
-						}
-						break
-					}
-					b := true
-
-					for k, v := range op.Data {
-						if k == "to" && v == "0x0000000000000000000000000000000000000089" {
-							b = false
-							break
-						}
-						if k == "to" && v == "0x0000000000000000000000000000000000000090" {
-							b = false
-							break
-						}
-						if k == "from" && v != "0xaa61079801f6ca8552a302aa8d27ccd0aca68694" {
-							b = false
-							break
-						}
-						if k == "finality" {
-							switch v.(type) {
-							case (int32):
-								v = float64(v.(int32))
-								break
-							}
-							op.Data["finality"] = v.(float64)
-						}
-					}
-
-					if !b {
-						break
-					}
-
-					if op.Data["to"] == nil {
-						op.Data["to"] = ""
-					}
-
-					if op.Data["timestamp"] == nil {
-						break
-					}
-
-					if err := influx.addPoint(op); err != nil {
-						exitStatus = 1
-						errorLog.Println(err)
-					}
 				}
 			}
 		}()
 	}
-	if config.DirectReads {
-		go func() {
-			gtmCtx.DirectReadWg.Wait()
-			infoLog.Println("Direct reads completed")
-			if config.Resume && config.ResumeStrategy == timestampResumeStrategy {
-				saveTimestampFromReplStatus(mongoClient, config)
-			}
-			if config.ExitAfterDirectReads {
-				gtmCtx.Stop()
-				wg.Wait()
-				stopC <- true
-			}
-		}()
+	env := &pipelineEnv{
+		client:         mongoClient,
+		sink:           sink,
+		checkpoints:    checkpoints,
+		token:          token,
+		bufferDuration: gtmBufferDuration,
+		stopC:          stopC,
+	}
+	p := startPipeline(config, env, after, directReadNs)
+	for running := true; running; {
+		select {
+		case <-hups:
+			infoLog.Printf("Reloading measurements from %s", config.ConfigFile)
+			p = p.reloadMeasurements(env)
+		case <-stopC:
+			running = false
+		}
 	}
-	<-stopC
 	infoLog.Println("Stopping all workers and shutting down")
-	gtmCtx.Stop()
+	logCounters()
+	p.stop()
+	closePlugins(p.config.Measurement)
+	if err := checkpoints.save(); err != nil {
+		exitStatus = 1
+		errorLog.Println(err)
+	}
 	mongoClient.Disconnect(context.Background())
-	influxClient.Close()
+	sink.Close()
 	os.Exit(exitStatus)
 }
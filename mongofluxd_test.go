@@ -0,0 +1,276 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func filterDoc() map[string]interface{} {
+	return map[string]interface{}{
+		"to":     "0x0000000000000000000000000000000000000089",
+		"from":   "0xaa61079801f6ca8552a302aa8d27ccd0aca68694",
+		"amount": int64(500),
+		"price":  2.5,
+		"status": "FILLED",
+		"maker":  true,
+		"at":     time.Unix(1000, 0),
+		"owner":  primitive.ObjectID{0x5d},
+		"meta":   map[string]interface{}{"venue": "tomox"},
+	}
+}
+
+func TestDocFilterMatches(t *testing.T) {
+	owner := primitive.ObjectID{0x5d}.Hex()
+	tests := []struct {
+		field, operator string
+		values          []interface{}
+		optional        bool
+		want            bool
+	}{
+		{"status", "eq", []interface{}{"FILLED"}, false, true},
+		{"status", "eq", []interface{}{"OPEN"}, false, false},
+		{"amount", "eq", []interface{}{500.0}, false, true},
+		{"amount", "eq", []interface{}{int64(500)}, false, true},
+		{"owner", "eq", []interface{}{owner}, false, true},
+		{"maker", "eq", []interface{}{true}, false, true},
+		{"meta.venue", "eq", []interface{}{"tomox"}, false, true},
+		{"missing", "eq", []interface{}{"x"}, false, false},
+		{"missing", "eq", []interface{}{"x"}, true, true},
+		{"from", "eq", []interface{}{"0xaa61079801f6ca8552a302aa8d27ccd0aca68694"}, true, true},
+		{"from", "eq", []interface{}{"0x01"}, true, false},
+		{"status", "ne", []interface{}{"OPEN"}, false, true},
+		{"status", "ne", []interface{}{"FILLED"}, false, false},
+		{"missing", "ne", []interface{}{"x"}, false, true},
+		{"to", "in", []interface{}{"0x01", "0x0000000000000000000000000000000000000089"}, false, true},
+		{"to", "in", []interface{}{"0x01"}, false, false},
+		{"missing", "in", []interface{}{"x"}, false, false},
+		{"to", "nin", []interface{}{"0x0000000000000000000000000000000000000089"}, false, false},
+		{"to", "nin", []interface{}{"0x01"}, false, true},
+		{"missing", "nin", []interface{}{"x"}, false, true},
+		{"status", "exists", nil, false, true},
+		{"missing", "exists", nil, false, false},
+		{"missing", "exists", []interface{}{false}, false, true},
+		{"status", "exists", []interface{}{false}, false, false},
+		{"status", "regex", []interface{}{"^FILL", "^OPEN"}, false, true},
+		{"status", "regex", []interface{}{"^OPEN"}, false, false},
+		{"amount", "regex", []interface{}{"5"}, false, false},
+		{"price", "gt", []interface{}{2}, false, true},
+		{"price", "gt", []interface{}{2.5}, false, false},
+		{"price", "lt", []interface{}{3}, false, true},
+		{"at", "gt", []interface{}{time.Unix(999, 0)}, false, true},
+		{"at", "lt", []interface{}{time.Unix(999, 0)}, false, false},
+		{"status", "lt", []interface{}{"G"}, false, true},
+		// values of different types never compare
+		{"price", "gt", []interface{}{"2"}, false, false},
+		{"status", "eq", []interface{}{1}, false, false},
+		{"maker", "eq", []interface{}{"true"}, false, false},
+		{"missing", "gt", []interface{}{1}, false, false},
+		{"missing", "gt", []interface{}{1}, true, true},
+	}
+	doc := filterDoc()
+	for _, test := range tests {
+		f, err := newDocFilter(&filterSettings{
+			Field:    test.field,
+			Operator: test.operator,
+			Values:   test.values,
+			Optional: test.optional,
+		})
+		if err != nil {
+			t.Errorf("%s %s %v: %s", test.field, test.operator, test.values, err)
+			continue
+		}
+		if got := f.matches(doc); got != test.want {
+			t.Errorf("%s %s %v (optional %t) = %t, want %t",
+				test.field, test.operator, test.values, test.optional, got, test.want)
+		}
+	}
+}
+
+func TestNewDocFilterErrors(t *testing.T) {
+	tests := []filterSettings{
+		{Operator: "eq", Values: []interface{}{"x"}},
+		{Field: "f", Operator: "like", Values: []interface{}{"x"}},
+		{Field: "f", Operator: "eq"},
+		{Field: "f", Operator: "eq", Values: []interface{}{"x", "y"}},
+		{Field: "f", Operator: "gt", Values: []interface{}{1, 2}},
+		{Field: "f", Operator: "in"},
+		{Field: "f", Operator: "nin"},
+		{Field: "f", Operator: "regex"},
+		{Field: "f", Operator: "regex", Values: []interface{}{1}},
+		{Field: "f", Operator: "regex", Values: []interface{}{"("}},
+		{Field: "f", Operator: "exists", Values: []interface{}{"yes"}},
+		{Field: "f", Operator: "exists", Values: []interface{}{true, false}},
+		{Field: "f", Operator: "exists", Optional: true},
+	}
+	for _, test := range tests {
+		fs := test
+		if _, err := newDocFilter(&fs); err == nil {
+			t.Errorf("newDocFilter(%+v) succeeded, want an error", test)
+		}
+	}
+}
+
+func TestTradesConfigKeepsOldChecks(t *testing.T) {
+	var config configOptions
+	if _, err := toml.DecodeFile("config/trades.toml", &config); err != nil {
+		t.Fatal(err)
+	}
+	if len(config.Measurement) != 1 {
+		t.Fatalf("expected one measurement, got %d", len(config.Measurement))
+	}
+	ms := config.Measurement[0]
+	im := &InfluxMeasure{defaults: ms.Defaults}
+	for _, fs := range ms.Filter {
+		f, err := newDocFilter(fs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		im.filters = append(im.filters, f)
+	}
+	tests := []struct {
+		doc  map[string]interface{}
+		want bool
+	}{
+		{map[string]interface{}{"to": "0x01", "from": "0xaa61079801f6ca8552a302aa8d27ccd0aca68694"}, true},
+		{map[string]interface{}{"from": "0xaa61079801f6ca8552a302aa8d27ccd0aca68694"}, true},
+		{map[string]interface{}{"to": "0x01"}, true},
+		{map[string]interface{}{"to": "0x01", "from": "0x02"}, false},
+		{map[string]interface{}{"to": "0x0000000000000000000000000000000000000089"}, false},
+		{map[string]interface{}{"to": "0x0000000000000000000000000000000000000090"}, false},
+	}
+	for _, test := range tests {
+		if got := im.accepts(test.doc); got != test.want {
+			t.Errorf("accepts(%v) = %t, want %t", test.doc, got, test.want)
+		}
+	}
+	if ms.OnMissing != onMissingSkip || len(ms.Required) != 1 || ms.Required[0] != "timestamp" {
+		t.Errorf("expected documents without a timestamp to be skipped, got required %v on-missing %q",
+			ms.Required, ms.OnMissing)
+	}
+	if ms.Defaults["to"] != "" {
+		t.Errorf("expected to default to an empty string, got %v", ms.Defaults["to"])
+	}
+}
+
+func TestMeasurementsBatchedApart(t *testing.T) {
+	ctx := &InfluxCtx{config: &configOptions{}, m: make(map[string]*Batch)}
+	raw := &InfluxMeasure{key: "tomodex.trades|trades|", database: "trades", precision: "ms"}
+	volume := &InfluxMeasure{key: "tomodex.trades|trades|volume", database: "trades", precision: "ms"}
+	a, err := ctx.setupDatabase(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ctx.setupDatabase(volume)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a == b {
+		t.Errorf("expected measurements with the same target to be batched apart")
+	}
+	if again, _ := ctx.setupDatabase(raw); again != a {
+		t.Errorf("expected the batch of a measurement to be reused")
+	}
+	if a.measure != raw.key || a.subset(nil).measure != raw.key {
+		t.Errorf("expected the batch to carry the measurement key, got %q", a.measure)
+	}
+}
+
+func TestSetupMeasurementsKeepsRequired(t *testing.T) {
+	required := make([]string, 1, 4)
+	required[0] = "hash"
+	config := &configOptions{Measurement: []*measureSettings{{
+		Namespace: "tomodex.trades",
+		Fields:    []string{"amount"},
+		Timefield: "createdAt",
+		Required:  required,
+	}}}
+	for i := 0; i < 2; i++ {
+		ctx := &InfluxCtx{
+			config:   config,
+			measures: make(map[string][]*InfluxMeasure),
+			matched:  make(map[string][]*InfluxMeasure),
+		}
+		if err := ctx.setupMeasurements(); err != nil {
+			t.Fatal(err)
+		}
+		im := ctx.measures["tomodex.trades"][0]
+		if len(im.required) != 2 || im.required[1] != "createdAt" {
+			t.Errorf("expected hash and the timefield to be required, got %v", im.required)
+		}
+	}
+	if ms := config.Measurement[0]; len(ms.Required) != 1 || required[:2][1] != "" {
+		t.Errorf("expected the configured required keys to stay untouched, got %v", required[:cap(required)])
+	}
+}
+
+func TestCoerceField(t *testing.T) {
+	d, err := primitive.ParseDecimal128("12.5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := time.Date(2020, 9, 13, 12, 26, 40, 5e6, time.UTC)
+	tests := []struct {
+		v    interface{}
+		kind string
+		want interface{}
+	}{
+		{int32(3), "float", 3.0},
+		{int64(-7), "float", -7.0},
+		{uint64(8), "float", 8.0},
+		{d, "float", 12.5},
+		{" 2.25 ", "float", 2.25},
+		{"abc", "float", nil},
+		{true, "float", nil},
+		{int32(3), "int", int64(3)},
+		{4.0, "int", int64(4)},
+		{4.5, "int", nil},
+		{"42", "int", int64(42)},
+		{"1e3", "int", int64(1000)},
+		{"1.5", "int", nil},
+		{d, "int", nil},
+		{uint64(math.MaxUint64), "int", nil},
+		{"s", "string", "s"},
+		{int32(5), "string", "5"},
+		{1.5, "string", "1.5"},
+		{float32(0.1), "string", "0.1"},
+		{false, "string", "false"},
+		{d, "string", "12.5"},
+		{primitive.ObjectID{0x5d}, "string", "5d0000000000000000000000"},
+		{at, "string", "2020-09-13T12:26:40.005Z"},
+		{uint64(math.MaxUint64), "string", "18446744073709551615"},
+		{nil, "string", nil},
+		{true, "bool", true},
+		{" false ", "bool", false},
+		{int64(1), "bool", true},
+		{0.0, "bool", false},
+		{int64(2), "bool", nil},
+		{"yes", "bool", nil},
+		{int64(7), "unsigned", uint64(7)},
+		{int64(-7), "unsigned", nil},
+		{at, "unix", int64(1600000000)},
+		{at, "unix_ms", int64(1600000000005)},
+		{at, "rfc3339", "2020-09-13T12:26:40.005Z"},
+		{[]byte{0xab, 0x01}, "hex", "ab01"},
+		{[]byte{0xab, 0x01}, "base64", "qwE="},
+	}
+	for _, test := range tests {
+		got, err := coerceField(test.v, test.kind)
+		if test.want == nil {
+			if err == nil {
+				t.Errorf("coerceField(%T %v, %s) = %v, want an error", test.v, test.v, test.kind, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("coerceField(%T %v, %s): %s", test.v, test.v, test.kind, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("coerceField(%T %v, %s) = %T %v, want %T %v", test.v, test.v, test.kind, got, got, test.want, test.want)
+		}
+	}
+}
@@ -1,6 +1,9 @@
 package mongofluxdplug
 
-import "time"
+import (
+	"errors"
+	"time"
+)
 
 // plugins must import this package
 // import "github.com/rwynn/mongofluxd/mongofluxdplug
@@ -11,6 +14,14 @@ import "time"
 // [[measurement]]
 // symbol = "MyPointMapper"
 
+// version 2 plugins instead implement a function per measurement returning a Plugin
+// e.g. func NewPointMapper() mongofluxdplug.Plugin
+// the Plugin is initialized with the plugin-config table of the measurement
+// [[measurement]]
+// symbol = "NewPointMapper"
+// [measurement.plugin-config]
+// pair = "TOMO/USDT"
+
 // plugins can be compiled using go build -buildmode=plugin -o myplugin.so myplugin.go
 // to enable the plugin start with mongofluxd -plugin-path /path/to/myplugin.so
 
@@ -22,6 +33,36 @@ type MongoDocument struct {
 	Operation  string                 // "i" for a insert or "u" for update
 }
 
+// APIVersion is the version of the Plugin interface
+const APIVersion = 2
+
+// ErrDrop is returned by Map to drop a document on purpose. The document is
+// counted as filtered instead of failed.
+var ErrDrop = errors.New("document dropped by plugin")
+
+// Plugin is implemented by version 2 plugins. A single Plugin maps the
+// documents of its measurement for every worker so Map must be safe for
+// concurrent use.
+type Plugin interface {
+	// Init is called once, before any document is mapped, with the
+	// plugin-config table of the measurement
+	Init(config map[string]interface{}) error
+	// Map returns the points of a document, or ErrDrop
+	Map(doc *Document) ([]*InfluxPoint, error)
+	// Close is called when mongofluxd stops or the measurement is reloaded
+	Close() error
+}
+
+// Document is the document passed to version 2 plugins along with its op
+type Document struct {
+	MongoDocument
+	Id                interface{}            // the _id of the document
+	Timestamp         time.Time              // the time of the oplog entry, zero for direct reads
+	Ordinal           uint32                 // orders the oplog entries of the same second
+	Source            string                 // "direct", "oplog" or "changestream"
+	UpdateDescription map[string]interface{} // the updatedFields and removedFields of a change stream update
+}
+
 type InfluxPoint struct {
 	Tags      map[string]string      // optional tags to set on the Point
 	Fields    map[string]interface{} // fields to set on the Point
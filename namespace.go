@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"regexp"
+	"regexp/syntax"
+	"sort"
+	"strings"
+
+	"github.com/rwynn/gtm"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// nsPattern matches the namespaces of a measurement configured with a glob
+// namespace such as tomodex.trades_* or with a namespace-regex
+type nsPattern struct {
+	src  string
+	glob bool
+	re   *regexp.Regexp
+	// db is the database of every matching namespace, if there is only one
+	db string
+}
+
+func isGlob(ns string) bool {
+	return strings.ContainsAny(ns, "*?[")
+}
+
+// name returns the namespace or pattern which identifies the measurement
+func (ms *measureSettings) name() string {
+	if ms.NamespaceRegex != "" {
+		return ms.NamespaceRegex
+	}
+	return ms.Namespace
+}
+
+// pattern returns the namespace pattern of the measurement, or nil if it
+// names a single namespace
+func (ms *measureSettings) pattern() (*nsPattern, error) {
+	if ms.NamespaceRegex != "" {
+		if ms.Namespace != "" {
+			return nil, fmt.Errorf("namespace %s and namespace-regex %s are exclusive", ms.Namespace, ms.NamespaceRegex)
+		}
+		// the expression must match the whole namespace
+		re, err := regexp.Compile("^(?:" + ms.NamespaceRegex + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid namespace-regex %s: %s", ms.NamespaceRegex, err)
+		}
+		p := &nsPattern{src: ms.NamespaceRegex, re: re}
+		if prefix := literalPrefix(ms.NamespaceRegex); strings.Contains(prefix, ".") {
+			p.db = strings.SplitN(prefix, ".", 2)[0]
+		}
+		return p, nil
+	}
+	if !isGlob(ms.Namespace) {
+		return nil, nil
+	}
+	if _, err := path.Match(ms.Namespace, ""); err != nil {
+		return nil, fmt.Errorf("invalid namespace pattern %s: %s", ms.Namespace, err)
+	}
+	p := &nsPattern{src: ms.Namespace, glob: true}
+	if db := strings.SplitN(ms.Namespace, ".", 2)[0]; !isGlob(db) && strings.Contains(ms.Namespace, ".") {
+		p.db = db
+	}
+	return p, nil
+}
+
+// literalPrefix returns the text every match of the expression starts with.
+// Unlike Regexp.LiteralPrefix it looks past a leading ^ or \A.
+func literalPrefix(src string) string {
+	re, err := syntax.Parse(src, syntax.Perl)
+	if err != nil {
+		return ""
+	}
+	re = re.Simplify()
+	subs := []*syntax.Regexp{re}
+	if re.Op == syntax.OpConcat {
+		subs = re.Sub
+	}
+	var prefix strings.Builder
+	for _, sub := range subs {
+		switch {
+		case sub.Op == syntax.OpBeginText && prefix.Len() == 0:
+		case sub.Op == syntax.OpLiteral && sub.Flags&syntax.FoldCase == 0:
+			prefix.WriteString(string(sub.Rune))
+		default:
+			return prefix.String()
+		}
+	}
+	return prefix.String()
+}
+
+func (p *nsPattern) matches(ns string) bool {
+	if p.glob {
+		ok, _ := path.Match(p.src, ns)
+		return ok
+	}
+	return p.re.MatchString(ns)
+}
+
+// nsMatcher tells whether a namespace belongs to one of a set of measurements
+type nsMatcher struct {
+	names    map[string]bool
+	patterns []*nsPattern
+}
+
+func newNsMatcher(mss []*measureSettings, include func(*measureSettings) bool) *nsMatcher {
+	m := &nsMatcher{names: make(map[string]bool)}
+	for _, ms := range mss {
+		if include != nil && !include(ms) {
+			continue
+		}
+		if p, err := ms.pattern(); err == nil && p != nil {
+			m.patterns = append(m.patterns, p)
+			continue
+		}
+		m.names[ms.Namespace] = true
+		if ms.View != "" {
+			m.names[ms.View] = true
+		}
+	}
+	return m
+}
+
+func (m *nsMatcher) matches(ns string) bool {
+	if m.names[ns] {
+		return true
+	}
+	for _, p := range m.patterns {
+		if p.matches(ns) {
+			return true
+		}
+	}
+	return false
+}
+
+// measuresFor returns the measurements of a namespace. Namespaces matched by
+// a pattern are resolved on their first op, so collections created at
+// runtime are picked up.
+func (ctx *InfluxCtx) measuresFor(ns string) []*InfluxMeasure {
+	if len(ctx.patterns) == 0 {
+		return ctx.measures[ns]
+	}
+	if measures, found := ctx.matched[ns]; found {
+		return measures
+	}
+	measures := append([]*InfluxMeasure(nil), ctx.measures[ns]...)
+	for _, im := range ctx.patterns {
+		if im.pattern.matches(ns) {
+			measures = append(measures, im)
+		}
+	}
+	ctx.matched[ns] = measures
+	return measures
+}
+
+// changeStreamNamespaces returns the namespaces to watch. Patterns watch the
+// database of their namespaces or, if it is not fixed, the whole deployment.
+func (config *configOptions) changeStreamNamespaces() []string {
+	watch := make(map[string]bool)
+	for _, ms := range config.Measurement {
+		p, _ := ms.pattern()
+		if p == nil {
+			watch[ms.Namespace] = true
+		} else {
+			watch[p.db] = true
+		}
+	}
+	if watch[""] {
+		return []string{""}
+	}
+	var nss []string
+	for ns := range watch {
+		if db := strings.SplitN(ns, ".", 2)[0]; db == ns || !watch[db] {
+			nss = append(nss, ns)
+		}
+	}
+	sort.Strings(nss)
+	return nss
+}
+
+// directReadNamespaces returns the namespaces to read directly, listing the
+// existing collections which match the patterns
+func (config *configOptions) directReadNamespaces(client *mongo.Client) ([]string, error) {
+	seen := make(map[string]bool)
+	var nss []string
+	add := func(ns string) {
+		if !seen[ns] {
+			seen[ns] = true
+			nss = append(nss, ns)
+		}
+	}
+	var patterns []*nsPattern
+	for _, ms := range config.Measurement {
+		p, err := ms.pattern()
+		if err != nil {
+			return nil, err
+		}
+		if p != nil {
+			patterns = append(patterns, p)
+		} else if ms.View != "" {
+			add(ms.View)
+		} else {
+			add(ms.Namespace)
+		}
+	}
+	if len(patterns) == 0 {
+		return nss, nil
+	}
+	var dbs []string
+	for _, p := range patterns {
+		if p.db == "" {
+			var err error
+			if dbs, err = client.ListDatabaseNames(context.Background(), bson.M{}); err != nil {
+				return nil, err
+			}
+			break
+		}
+		dbs = append(dbs, p.db)
+	}
+	for _, db := range dbs {
+		if db == Name || db == "admin" || db == "local" || db == "config" {
+			continue
+		}
+		cols, err := client.Database(db).ListCollectionNames(context.Background(), bson.M{})
+		if err != nil {
+			return nil, err
+		}
+		sort.Strings(cols)
+		for _, col := range cols {
+			ns := db + "." + col
+			if strings.HasPrefix(col, "system.") {
+				continue
+			}
+			for _, p := range patterns {
+				if p.matches(ns) {
+					add(ns)
+					break
+				}
+			}
+		}
+	}
+	return nss, nil
+}
+
+// onlyMeasured passes the ops of namespaces which have a measurement
+func (config *configOptions) onlyMeasured() gtm.OpFilter {
+	measured := newNsMatcher(config.Measurement, nil)
+	if config.ChangeStreams && len(measured.patterns) == 0 {
+		return func(op *gtm.Op) bool {
+			return true
+		}
+	}
+	return func(op *gtm.Op) bool {
+		return measured.matches(op.Namespace)
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import "testing"
+
+func TestNamespacePatternDatabase(t *testing.T) {
+	tests := []struct {
+		ms *measureSettings
+		db string
+	}{
+		{&measureSettings{Namespace: "tomodex.trades_*"}, "tomodex"},
+		{&measureSettings{Namespace: "*.trades"}, ""},
+		{&measureSettings{NamespaceRegex: `tomodex\.trades_\d+`}, "tomodex"},
+		{&measureSettings{NamespaceRegex: `^tomodex\.trades_.*$`}, "tomodex"},
+		{&measureSettings{NamespaceRegex: `\Atomodex\.trades`}, "tomodex"},
+		{&measureSettings{NamespaceRegex: `tomodex_(a|b)\.trades`}, ""},
+		{&measureSettings{NamespaceRegex: `(?i)tomodex\.trades`}, ""},
+		{&measureSettings{NamespaceRegex: `tomodex.trades`}, ""},
+	}
+	for _, test := range tests {
+		p, err := test.ms.pattern()
+		if err != nil {
+			t.Errorf("%s: %s", test.ms.name(), err)
+			continue
+		}
+		if p.db != test.db {
+			t.Errorf("%s: expected database %q, got %q", test.ms.name(), test.db, p.db)
+		}
+	}
+}
+
+func TestNamespacePatternMatches(t *testing.T) {
+	tests := []struct {
+		ms      *measureSettings
+		ns      string
+		matches bool
+	}{
+		{&measureSettings{Namespace: "tomodex.trades_*"}, "tomodex.trades_2019", true},
+		{&measureSettings{Namespace: "tomodex.trades_*"}, "tomodex.orders", false},
+		{&measureSettings{NamespaceRegex: `^tomodex\.trades_.*$`}, "tomodex.trades_2019", true},
+		{&measureSettings{NamespaceRegex: `tomodex\.trades_\d+`}, "tomodex.trades_2019", true},
+		{&measureSettings{NamespaceRegex: `tomodex\.trades_\d+`}, "tomodex.trades_2019x", false},
+		{&measureSettings{NamespaceRegex: `tomodex\.trades_\d+`}, "x.tomodex.trades_1", false},
+	}
+	for _, test := range tests {
+		p, err := test.ms.pattern()
+		if err != nil {
+			t.Errorf("%s: %s", test.ms.name(), err)
+			continue
+		}
+		if got := p.matches(test.ns); got != test.matches {
+			t.Errorf("%s matching %s = %t, want %t", test.ms.name(), test.ns, got, test.matches)
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync/atomic"
+
+	client "github.com/influxdata/influxdb1-client/v2"
+)
+
+// InfluxDB reports each conflicting point of a partial write as
+// field type conflict: input field "f" on measurement "m" is type integer, already exists as type float
+var fieldConflictRe = regexp.MustCompile(
+	`field type conflict: input field "((?:[^"\\]|\\.)*)" on measurement "((?:[^"\\]|\\.)*)" is type (\w+), already exists as type (\w+)`)
+
+type fieldConflict struct {
+	field    string
+	measure  string
+	kind     string
+	existing string
+}
+
+func (fc *fieldConflict) String() string {
+	return fmt.Sprintf("field type conflict on field %s of measurement %s: %s given but %s expected",
+		fc.field, fc.measure, fc.kind, fc.existing)
+}
+
+// isPointError reports whether the write failed because of the content of
+// some points rather than a problem reaching InfluxDB. These are not retried.
+func isPointError(err error) bool {
+	msg := err.Error()
+	for _, s := range []string{
+		"partial write",
+		"field type conflict",
+		"unable to parse",
+		"points beyond retention policy",
+		"max-values-per-tag limit exceeded",
+	} {
+		if strings.Contains(msg, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func parseFieldConflicts(err error) (conflicts []*fieldConflict) {
+	for _, m := range fieldConflictRe.FindAllStringSubmatch(err.Error(), -1) {
+		conflicts = append(conflicts, &fieldConflict{
+			field:    strings.Replace(m[1], `\"`, `"`, -1),
+			measure:  strings.Replace(m[2], `\"`, `"`, -1),
+			kind:     m[3],
+			existing: m[4],
+		})
+	}
+	return
+}
+
+func influxFieldType(v interface{}) string {
+	switch v.(type) {
+	case float32, float64:
+		return "float"
+	case int, int8, int16, int32, int64:
+		return "integer"
+	case uint, uint8, uint16, uint32, uint64:
+		return "unsigned"
+	case string:
+		return "string"
+	case bool:
+		return "boolean"
+	default:
+		return ""
+	}
+}
+
+// conflictOf returns the conflict which pt is responsible for, if any
+func conflictOf(pt *client.Point, conflicts []*fieldConflict) *fieldConflict {
+	for _, fc := range conflicts {
+		if pt.Name() != fc.measure {
+			continue
+		}
+		fields, err := pt.Fields()
+		if err != nil {
+			continue
+		}
+		if v, ok := fields[fc.field]; ok && influxFieldType(v) == fc.kind {
+			return fc
+		}
+	}
+	return nil
+}
+
+func (ctx *InfluxCtx) writeWithRetry(bp *Batch) (int, error) {
+	return ctx.retry.retry(func() error {
+		err := ctx.sink.WriteBatch(bp)
+		if err != nil && ctx.config.Verbose {
+			infoLog.Printf("Write of %d points to %s failed: %s\n", len(bp.Points), bp.Database, err)
+		}
+		return err
+	}, isPointError)
+}
+
+// isolate handles a batch that InfluxDB rejected in part. Points named by a
+// field type conflict are rejected directly; otherwise the batch is split in
+// half until the offending points are found. The remaining points are
+// written and an error is only returned if a write fails for another reason.
+func (ctx *InfluxCtx) isolate(bp *Batch, cause error) error {
+	if conflicts := parseFieldConflicts(cause); len(conflicts) > 0 {
+		var good []int
+		for i, pt := range bp.Points {
+			if fc := conflictOf(pt, conflicts); fc != nil {
+				ctx.reject(bp.subset([]int{i}), fc.String())
+			} else {
+				good = append(good, i)
+			}
+		}
+		if len(good) < len(bp.Points) {
+			return ctx.writeIsolated(bp.subset(good))
+		}
+	}
+	if len(bp.Points) == 1 {
+		ctx.reject(bp, cause.Error())
+		return nil
+	}
+	var left, right []int
+	for i := range bp.Points {
+		if i < len(bp.Points)/2 {
+			left = append(left, i)
+		} else {
+			right = append(right, i)
+		}
+	}
+	if err := ctx.writeIsolated(bp.subset(left)); err != nil {
+		return err
+	}
+	return ctx.writeIsolated(bp.subset(right))
+}
+
+func (ctx *InfluxCtx) writeIsolated(bp *Batch) error {
+	if len(bp.Points) == 0 {
+		return nil
+	}
+	_, err := ctx.writeWithRetry(bp)
+	if err != nil && isPointError(err) {
+		return ctx.isolate(bp, err)
+	}
+	return err
+}
+
+func (ctx *InfluxCtx) reject(bp *Batch, reason string) {
+	for _, pt := range bp.Points {
+		atomic.AddInt64(&counters.rejected, 1)
+		errorLog.Printf("Rejected point in %s: %s: %s\n", bp.Database, reason, pt.String())
+	}
+	ctx.deadLetterBatch(bp, fmt.Errorf("point rejected by InfluxDB: %s", reason))
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	client "github.com/influxdata/influxdb1-client/v2"
+	"github.com/rwynn/gtm"
+)
+
+func TestParseFieldConflicts(t *testing.T) {
+	tests := []struct {
+		msg  string
+		want []fieldConflict
+	}{
+		{"timeout", nil},
+		{
+			`partial write: field type conflict: input field "price" on measurement "trades" is type integer, already exists as type float dropped=1`,
+			[]fieldConflict{{"price", "trades", "integer", "float"}},
+		},
+		{
+			`partial write: field type conflict: input field "a\"b" on measurement "my \"trades\"" is type string, already exists as type boolean dropped=1`,
+			[]fieldConflict{{`a"b`, `my "trades"`, "string", "boolean"}},
+		},
+		{
+			`partial write: field type conflict: input field "price" on measurement "trades" is type integer, already exists as type float; ` +
+				`field type conflict: input field "side" on measurement "orders" is type boolean, already exists as type string dropped=2`,
+			[]fieldConflict{
+				{"price", "trades", "integer", "float"},
+				{"side", "orders", "boolean", "string"},
+			},
+		},
+	}
+	for _, test := range tests {
+		conflicts := parseFieldConflicts(errors.New(test.msg))
+		if len(conflicts) != len(test.want) {
+			t.Errorf("parseFieldConflicts(%q) found %d conflicts, want %d", test.msg, len(conflicts), len(test.want))
+			continue
+		}
+		for i, fc := range conflicts {
+			if *fc != test.want[i] {
+				t.Errorf("parseFieldConflicts(%q)[%d] = %+v, want %+v", test.msg, i, *fc, test.want[i])
+			}
+		}
+	}
+}
+
+// rejectSink fails every write holding a point it rejects and writes nothing
+// of it, like a server which rejects the whole request
+type rejectSink struct {
+	reject  func(pt *client.Point) error
+	written map[string]bool
+}
+
+func (s *rejectSink) EnsureDatabase(db string) error {
+	return nil
+}
+
+func (s *rejectSink) WriteBatch(b *Batch) error {
+	var errs []string
+	for _, pt := range b.Points {
+		if err := s.reject(pt); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("partial write: %s dropped=%d", strings.Join(errs, "; "), len(errs))
+	}
+	for _, pt := range b.Points {
+		s.written[pt.String()] = true
+	}
+	return nil
+}
+
+func (s *rejectSink) Close() error {
+	return nil
+}
+
+func TestIsolate(t *testing.T) {
+	unparsable := func(bad ...int) func(pt *client.Point) error {
+		return func(pt *client.Point) error {
+			fields, _ := pt.Fields()
+			for _, i := range bad {
+				if fields["n"] == int64(i) {
+					return fmt.Errorf("unable to parse point %d", i)
+				}
+			}
+			return nil
+		}
+	}
+	conflicting := func(pt *client.Point) error {
+		fields, _ := pt.Fields()
+		if _, ok := fields["price"].(int64); ok {
+			return fmt.Errorf(`field type conflict: input field "price" on measurement "%s" is type integer, already exists as type float`, pt.Name())
+		}
+		return nil
+	}
+	tests := []struct {
+		name   string
+		reject func(pt *client.Point) error
+		bad    []int
+	}{
+		{"single unparsable point", unparsable(3), []int{3}},
+		{"several unparsable points", unparsable(0, 4, 5), []int{0, 4, 5}},
+		{"every point unparsable", unparsable(0, 1, 2, 3, 4, 5, 6), []int{0, 1, 2, 3, 4, 5, 6}},
+		{"field type conflicts", conflicting, []int{2, 6}},
+	}
+	for _, test := range tests {
+		sink := &rejectSink{reject: test.reject, written: make(map[string]bool)}
+		ctx := &InfluxCtx{
+			config: &configOptions{},
+			sink:   sink,
+			retry:  &backoff{maxAttempts: 1},
+		}
+		bp := &Batch{Database: "test", Precision: "s"}
+		bad := make(map[string]bool)
+		for i := 0; i < 7; i++ {
+			fields := map[string]interface{}{"n": int64(i), "price": 1.5}
+			if i == 2 || i == 6 {
+				fields["price"] = int64(1)
+			}
+			pt, err := client.NewPoint("trades", nil, fields, time.Unix(int64(i), 0))
+			if err != nil {
+				t.Fatal(err)
+			}
+			bp.add(pt, &gtm.Op{})
+			for _, b := range test.bad {
+				if b == i {
+					bad[pt.String()] = true
+				}
+			}
+		}
+		rejected := atomic.LoadInt64(&counters.rejected)
+		err := sink.WriteBatch(bp)
+		if err == nil {
+			t.Fatalf("%s: expected the batch to be rejected", test.name)
+		}
+		if err = ctx.isolate(bp, err); err != nil {
+			t.Errorf("%s: unexpected error %s", test.name, err)
+		}
+		if n := atomic.LoadInt64(&counters.rejected) - rejected; n != int64(len(test.bad)) {
+			t.Errorf("%s: expected %d points rejected, got %d", test.name, len(test.bad), n)
+		}
+		for _, pt := range bp.Points {
+			if written := sink.written[pt.String()]; written == bad[pt.String()] {
+				t.Errorf("%s: point %s written %t", test.name, pt.String(), written)
+			}
+		}
+	}
+}
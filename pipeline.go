@@ -0,0 +1,274 @@
+package main
+
+import (
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rwynn/gtm"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// pipelineEnv holds what outlives a pipeline when gtm is restarted
+type pipelineEnv struct {
+	client         *mongo.Client
+	sink           Sink
+	checkpoints    *checkpointer
+	token          gtm.ResumeTokenGenenerator
+	bufferDuration time.Duration
+	stopC          chan bool
+}
+
+// pipeline is a running gtm along with the workers mapping its ops
+type pipeline struct {
+	config   *configOptions
+	gtmCtx   *gtm.OpCtx
+	wg       sync.WaitGroup
+	reloads  []chan *reload
+	finished chan struct{}
+	stopped  int32
+	// readsDone is set once the direct reads, if any, have completed
+	readsDone int32
+	// started is the position gtm started from
+	startedMutex sync.Mutex
+	started      primitive.Timestamp
+	// unwritten holds the batches the workers could not write before exiting
+	unwrittenMutex sync.Mutex
+	unwritten      []*Batch
+}
+
+func startPipeline(config *configOptions, env *pipelineEnv, after gtm.TimestampGenerator, directReadNs []string) *pipeline {
+	var changeStreamNs []string
+	if config.ChangeStreams {
+		changeStreamNs = config.changeStreamNamespaces()
+	}
+	filter := gtm.ChainOpFilters(NotMongoFlux, config.onlyMeasured(), config.handledOps())
+	p := &pipeline{
+		config:   config,
+		finished: make(chan struct{}),
+	}
+	p.gtmCtx = gtm.Start(env.client, &gtm.Options{
+		After:               p.recordStart(after),
+		Token:               env.token,
+		Log:                 infoLog,
+		NamespaceFilter:     filter,
+		OpLogDisabled:       len(changeStreamNs) > 0,
+		OpLogDatabaseName:   config.MongoOpLogDatabaseName,
+		OpLogCollectionName: config.MongoOpLogCollectionName,
+		ChannelSize:         config.GtmSettings.ChannelSize,
+		Ordering:            gtm.AnyOrder,
+		WorkerCount:         4,
+		BufferDuration:      env.bufferDuration,
+		BufferSize:          config.GtmSettings.BufferSize,
+		DirectReadNs:        directReadNs,
+		ChangeStreamNs:      changeStreamNs,
+	})
+	var workers []chan *gtm.Op
+	for i := 1; i <= config.InfluxClients; i++ {
+		reloads := make(chan *reload, 1)
+		p.reloads = append(p.reloads, reloads)
+		ops := make(chan *gtm.Op, config.GtmSettings.ChannelSize)
+		workers = append(workers, ops)
+		p.wg.Add(1)
+		go p.work(env, ops, reloads)
+	}
+	go p.dispatch(workers)
+	go func() {
+		p.wg.Wait()
+		close(p.finished)
+	}()
+	if len(directReadNs) > 0 {
+		go p.directReadsDone(env)
+	} else {
+		p.readsDone = 1
+	}
+	return p
+}
+
+// recordStart remembers the position gtm starts from, so that a restart
+// before any op has settled does not skip the ops gtm had not yet delivered
+func (p *pipeline) recordStart(after gtm.TimestampGenerator) gtm.TimestampGenerator {
+	if after == nil {
+		after = gtm.LastOpTimestamp
+	}
+	return func(client *mongo.Client, options *gtm.Options) (primitive.Timestamp, error) {
+		ts, err := after(client, options)
+		if err == nil {
+			p.startedMutex.Lock()
+			if p.started.T == 0 || tsLess(ts, p.started) {
+				p.started = ts
+			}
+			p.startedMutex.Unlock()
+		}
+		return ts, err
+	}
+}
+
+// startedAt returns the position gtm started from, if it has started
+func (p *pipeline) startedAt() primitive.Timestamp {
+	p.startedMutex.Lock()
+	defer p.startedMutex.Unlock()
+	return p.started
+}
+
+// dispatch hands the ops of gtm to the workers. All the ops of a document go
+// to the same worker, so a delete is only mapped once the points of earlier
+// ops on the document are written and remembered.
+func (p *pipeline) dispatch(workers []chan *gtm.Op) {
+	for op := range p.gtmCtx.OpC {
+		if op != nil {
+			workers[opWorker(op, len(workers))] <- op
+		}
+	}
+	for _, ops := range workers {
+		close(ops)
+	}
+}
+
+// opWorker returns the worker of the document of op
+func opWorker(op *gtm.Op, workers int) int {
+	h := fnv.New32a()
+	h.Write([]byte(op.Namespace))
+	h.Write([]byte(idKey(op.Id)))
+	return int(h.Sum32() % uint32(workers))
+}
+
+func (p *pipeline) work(env *pipelineEnv, ops chan *gtm.Op, reloads chan *reload) {
+	defer p.wg.Done()
+	flusher := time.NewTicker(1 * time.Second)
+	defer flusher.Stop()
+	influx, err := newInfluxCtx(p.config, env.sink, env.client, env.checkpoints)
+	if err == nil {
+		err = influx.applyTargets()
+	}
+	if err != nil {
+		errorLog.Fatalf("Configuration error: %s", err)
+	}
+	checkpoints := env.checkpoints
+	for {
+		select {
+		case <-flusher.C:
+			influx.flushLookups()
+			if err := influx.writeBatch(); err != nil {
+				exitStatus = 1
+				errorLog.Println(err)
+			}
+		case r := <-reloads:
+			influx.reload(r)
+		case err = <-p.gtmCtx.ErrC:
+			if err == nil {
+				break
+			}
+			exitStatus = 1
+			errorLog.Println(err)
+		case op, open := <-ops:
+			if op == nil {
+				if !open {
+					influx.flushLookups()
+					if err := influx.writeBatch(); err != nil {
+						exitStatus = 1
+						errorLog.Println(err)
+					}
+					p.keepUnwritten(influx)
+					return
+				}
+				break
+			}
+			checkpoints.track(op)
+			if err := influx.addPoint(op); err != nil {
+				influx.fail(op, stageMap, err)
+			}
+			checkpoints.release(op)
+		}
+	}
+}
+
+func (p *pipeline) directReadsDone(env *pipelineEnv) {
+	p.gtmCtx.DirectReadWg.Wait()
+	if atomic.LoadInt32(&p.stopped) == 1 {
+		return
+	}
+	atomic.StoreInt32(&p.readsDone, 1)
+	config := p.config
+	infoLog.Println("Direct reads completed")
+	if config.Resume && config.ResumeStrategy == timestampResumeStrategy {
+		if rs, err := gtm.GetReplStatus(env.client); err == nil {
+			if ts, err := rs.GetLastCommitted(); err == nil {
+				env.checkpoints.advance(ts)
+			}
+		}
+	}
+	if config.ExitAfterDirectReads {
+		// the position of the replica set only counts once gtm can no longer
+		// deliver older ops, so wait for it to settle before the final save
+		time.Sleep(env.checkpoints.untilSettled())
+		p.stop()
+		env.stopC <- true
+	}
+}
+
+// keepUnwritten takes over the batches of an exiting worker. Their ops stay
+// held so the resume position remains before them.
+func (p *pipeline) keepUnwritten(influx *InfluxCtx) {
+	p.unwrittenMutex.Lock()
+	defer p.unwrittenMutex.Unlock()
+	for _, bp := range influx.m {
+		p.unwritten = append(p.unwritten, bp)
+	}
+}
+
+// releaseUnwritten drops the ops of the unwritten batches once a restarted
+// gtm is set to read them again
+func (p *pipeline) releaseUnwritten(cp *checkpointer) {
+	p.unwrittenMutex.Lock()
+	defer p.unwrittenMutex.Unlock()
+	again, lost := 0, 0
+	for _, bp := range p.unwritten {
+		for _, op := range bp.ops {
+			if op.IsSourceOplog() {
+				again++
+			} else {
+				lost++
+			}
+		}
+		cp.releaseBatch(bp)
+	}
+	if again > 0 {
+		infoLog.Printf("%d unwritten points are mapped again after the restart", again)
+	}
+	if lost > 0 {
+		exitStatus = 1
+		errorLog.Printf("%d unwritten points of direct reads are lost", lost)
+	}
+	p.unwritten = nil
+}
+
+// halt stops gtm once. The workers write what they have batched and exit.
+func (p *pipeline) halt() {
+	if atomic.CompareAndSwapInt32(&p.stopped, 0, 1) {
+		p.gtmCtx.Stop()
+	}
+}
+
+// stop halts the pipeline and waits for its workers to exit
+func (p *pipeline) stop() {
+	p.halt()
+	<-p.finished
+}
+
+// wait waits for wg unless the workers have exited
+func (p *pipeline) wait(wg *sync.WaitGroup) bool {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-p.finished:
+		return false
+	}
+}
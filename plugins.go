@@ -0,0 +1,56 @@
+package main
+
+import (
+	"time"
+
+	"github.com/rwynn/gtm"
+	"github.com/tomochain/mongofluxd/mongofluxdplug"
+)
+
+// funcPlugin adapts the mapping function of a version 1 plugin
+type funcPlugin func(*mongofluxdplug.MongoDocument) ([]*mongofluxdplug.InfluxPoint, error)
+
+func (f funcPlugin) Init(config map[string]interface{}) error {
+	return nil
+}
+
+func (f funcPlugin) Map(doc *mongofluxdplug.Document) ([]*mongofluxdplug.InfluxPoint, error) {
+	return f(&doc.MongoDocument)
+}
+
+func (f funcPlugin) Close() error {
+	return nil
+}
+
+func pluginDocument(op *gtm.Op) *mongofluxdplug.Document {
+	doc := &mongofluxdplug.Document{
+		MongoDocument: mongofluxdplug.MongoDocument{
+			Data:       op.Data,
+			Namespace:  op.Namespace,
+			Database:   op.GetDatabase(),
+			Collection: op.GetCollection(),
+			Operation:  op.Operation,
+		},
+		Id:                op.Id,
+		Source:            sourceName(op),
+		UpdateDescription: op.UpdateDescription,
+	}
+	if op.Timestamp.T != 0 {
+		doc.Timestamp = time.Unix(int64(op.Timestamp.T), 0).UTC()
+		doc.Ordinal = op.Timestamp.I
+	}
+	return doc
+}
+
+// closePlugins closes the plugins of the measurements once they are no longer
+// used, i.e. on shutdown or after a reload
+func closePlugins(mss []*measureSettings) {
+	for _, ms := range mss {
+		if ms.plug == nil {
+			continue
+		}
+		if err := ms.plug.Close(); err != nil {
+			errorLog.Printf("Unable to close plugin symbol <%s>: %s", ms.Symbol, err)
+		}
+	}
+}
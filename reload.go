@@ -0,0 +1,183 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/BurntSushi/toml"
+)
+
+// reload carries a new configuration to the workers. Every worker writes its
+// batches and prepares the new measurements, then waits on swap so that all
+// of them switch together.
+type reload struct {
+	config *configOptions
+	ready  sync.WaitGroup
+	swap   chan struct{}
+	done   sync.WaitGroup
+}
+
+// loadMeasurements reads the measurements of the config file again, along
+// with their plugin symbols. The other settings require a restart.
+func (config *configOptions) loadMeasurements() ([]*measureSettings, error) {
+	if config.ConfigFile == "" {
+		return nil, fmt.Errorf("no config file to reload")
+	}
+	var tomlConfig configOptions
+	if _, err := toml.DecodeFile(config.ConfigFile, &tomlConfig); err != nil {
+		return nil, err
+	}
+	if len(tomlConfig.Measurement) == 0 {
+		return nil, fmt.Errorf("at least one measurement is required")
+	}
+	if err := config.loadPlugins(tomlConfig.Measurement); err != nil {
+		return nil, err
+	}
+	return tomlConfig.Measurement, nil
+}
+
+// namespaceKey identifies the namespaces gtm is started with, and which of
+// them pass deletes. gtm only has to be restarted when it changes.
+func (config *configOptions) namespaceKey() string {
+	seen := make(map[string]bool)
+	var keys []string
+	for _, ms := range config.Measurement {
+		onDelete := strings.ToLower(ms.OnDelete)
+		key := fmt.Sprintf("%s|%s|%s|%t", ms.Namespace, ms.NamespaceRegex, ms.View,
+			onDelete != "" && onDelete != onDeleteIgnore)
+		if !seen[key] {
+			seen[key] = true
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return strings.Join(keys, "\n")
+}
+
+// reload writes what is batched and switches to the measurements of r
+func (ctx *InfluxCtx) reload(r *reload) {
+	ctx.flushLookups()
+	if err := ctx.writeBatch(); err != nil {
+		exitStatus = 1
+		errorLog.Println(err)
+	}
+	fresh := &InfluxCtx{
+		config:   r.config,
+		sink:     ctx.sink,
+		measures: make(map[string][]*InfluxMeasure),
+		matched:  make(map[string][]*InfluxMeasure),
+	}
+	err := fresh.setupMeasurements()
+	r.ready.Done()
+	<-r.swap
+	if err == nil {
+		// the sink only takes the new targets once the swap is committed
+		err = fresh.applyTargets()
+	}
+	if err != nil {
+		exitStatus = 1
+		errorLog.Printf("Unable to reload measurements: %s", err)
+	} else {
+		ctx.config = r.config
+		ctx.measures = fresh.measures
+		ctx.patterns = fresh.patterns
+		ctx.matched = fresh.matched
+		ctx.targets = fresh.targets
+	}
+	r.done.Done()
+}
+
+// swap switches every worker of the pipeline to the measurements of config.
+// No worker maps an op with the new measurements before all have written
+// their batches.
+func (p *pipeline) swap(config *configOptions) {
+	r := &reload{
+		config: config,
+		swap:   make(chan struct{}),
+	}
+	r.ready.Add(len(p.reloads))
+	r.done.Add(len(p.reloads))
+	for _, reloads := range p.reloads {
+		select {
+		case reloads <- r:
+		case <-p.finished:
+		}
+	}
+	if p.wait(&r.ready) {
+		close(r.swap)
+		p.wait(&r.done)
+	}
+	p.config = config
+}
+
+// reloadMeasurements applies the measurements of the config file and returns
+// the pipeline now running. An invalid configuration is logged and ignored.
+// When the namespaces change gtm is restarted after the resume position of
+// the ops already handled.
+func (p *pipeline) reloadMeasurements(env *pipelineEnv) *pipeline {
+	mss, err := p.config.loadMeasurements()
+	if err != nil {
+		errorLog.Printf("Unable to reload configuration file %s: %s", p.config.ConfigFile, err)
+		return p
+	}
+	current := p.config
+	next := *current
+	next.Measurement = mss
+	// the measurements are checked against the sink without changing it
+	if _, err := newInfluxCtx(&next, env.sink, env.client, nil); err != nil {
+		closePlugins(mss)
+		errorLog.Printf("Configuration error, keeping the current measurements: %s", err)
+		return p
+	}
+	if next.namespaceKey() == current.namespaceKey() {
+		p.swap(&next)
+		closePlugins(current.Measurement)
+		infoLog.Printf("Reloaded %d measurements", len(mss))
+		return p
+	}
+	var directReadNs []string
+	if next.DirectReads {
+		// only the namespaces which are new are read directly, unless the
+		// direct reads of the current namespaces are still running
+		var readNs []string
+		if atomic.LoadInt32(&p.readsDone) == 1 {
+			readNs, err = current.directReadNamespaces(env.client)
+		}
+		if err == nil {
+			directReadNs, err = next.directReadNamespaces(env.client)
+		}
+		if err != nil {
+			closePlugins(mss)
+			errorLog.Printf("Unable to list namespaces for direct reads, keeping the current measurements: %s", err)
+			return p
+		}
+		read := make(map[string]bool)
+		for _, ns := range readNs {
+			read[ns] = true
+		}
+		var added []string
+		for _, ns := range directReadNs {
+			if !read[ns] {
+				added = append(added, ns)
+			}
+		}
+		directReadNs = added
+	}
+	infoLog.Println("Namespaces changed, restarting gtm")
+	p.stop()
+	closePlugins(current.Measurement)
+	if err := env.checkpoints.save(); err != nil {
+		exitStatus = 1
+		errorLog.Println(err)
+	}
+	// gtm restarts before the ops of batches which could not be written, so
+	// they no longer need to hold back the position
+	after := env.checkpoints.restartAfter(p.startedAt())
+	p.releaseUnwritten(env.checkpoints)
+	np := startPipeline(&next, env, after, directReadNs)
+	infoLog.Printf("Reloaded %d measurements", len(mss))
+	return np
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+type retrySettings struct {
+	MaxAttempts     int    `toml:"max-attempts"`
+	MaxElapsed      string `toml:"max-elapsed"`
+	InitialInterval string `toml:"initial-interval"`
+	MaxInterval     string `toml:"max-interval"`
+	Multiplier      float64
+	Jitter          float64
+}
+
+// backoff retries an operation with exponentially growing, jittered waits
+// until it succeeds or the attempt or elapsed time budget is spent
+type backoff struct {
+	maxAttempts int
+	maxElapsed  time.Duration
+	initial     time.Duration
+	max         time.Duration
+	multiplier  float64
+	jitter      float64
+}
+
+func RetryDefaultSettings() retrySettings {
+	return retrySettings{
+		MaxAttempts:     5,
+		MaxElapsed:      "2m",
+		InitialInterval: "500ms",
+		MaxInterval:     "30s",
+		Multiplier:      2,
+		Jitter:          0.2,
+	}
+}
+
+func parseOptionalDuration(name, value string) (time.Duration, error) {
+	if value == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("Unable to parse %s %s: %s", name, value, err)
+	}
+	return d, nil
+}
+
+func (rs *retrySettings) backoff() (b *backoff, err error) {
+	b = &backoff{
+		maxAttempts: rs.MaxAttempts,
+		multiplier:  rs.Multiplier,
+		jitter:      rs.Jitter,
+	}
+	if b.maxElapsed, err = parseOptionalDuration("max-elapsed", rs.MaxElapsed); err != nil {
+		return nil, err
+	}
+	if b.initial, err = parseOptionalDuration("initial-interval", rs.InitialInterval); err != nil {
+		return nil, err
+	}
+	if b.max, err = parseOptionalDuration("max-interval", rs.MaxInterval); err != nil {
+		return nil, err
+	}
+	if b.multiplier < 1 {
+		b.multiplier = 1
+	}
+	if b.jitter < 0 || b.jitter > 1 {
+		return nil, fmt.Errorf("retry jitter must be between 0 and 1")
+	}
+	return b, nil
+}
+
+func (b *backoff) wait(interval time.Duration) time.Duration {
+	if b.jitter == 0 || interval <= 0 {
+		return interval
+	}
+	delta := b.jitter * float64(interval)
+	return time.Duration(float64(interval) - delta + rand.Float64()*2*delta)
+}
+
+// retry calls fn until it returns nil, a permanent error or the budget is
+// exhausted. The last error is returned along with the number of attempts.
+func (b *backoff) retry(fn func() error, permanent func(error) bool) (attempts int, err error) {
+	start := time.Now()
+	interval := b.initial
+	for {
+		attempts++
+		if err = fn(); err == nil {
+			return
+		}
+		if permanent != nil && permanent(err) {
+			return
+		}
+		if b.maxAttempts > 0 && attempts >= b.maxAttempts {
+			return
+		}
+		wait := b.wait(interval)
+		if b.maxElapsed > 0 && time.Since(start)+wait > b.maxElapsed {
+			return
+		}
+		time.Sleep(wait)
+		interval = time.Duration(float64(interval) * b.multiplier)
+		if b.max > 0 && interval > b.max {
+			interval = b.max
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// pathSegment is one step of a path selector: a map key, an array index
+// counted from the end when negative, or a wildcard over either
+type pathSegment struct {
+	key      string
+	index    int
+	isIndex  bool
+	wildcard bool
+}
+
+// pathSelector picks values out of a document with paths such as
+// legs[0].price, items[-1].qty or meta.*. The output name may refer to the
+// matched key and path as {{key}} and {{path}}, e.g. meta.*:meta_{{key}}.
+type pathSelector struct {
+	spec     string
+	name     string
+	segments []pathSegment
+	wildcard bool
+}
+
+type pathMatch struct {
+	path  string
+	key   string
+	value interface{}
+}
+
+// isSelector reports whether path uses array indexes or wildcards rather
+// than naming a flattened key
+func isSelector(path string) bool {
+	return strings.ContainsAny(path, "[*")
+}
+
+func parseSelector(spec, name string) (*pathSelector, error) {
+	s := &pathSelector{spec: spec, name: name}
+	for _, part := range strings.Split(spec, ".") {
+		key := part
+		if i := strings.IndexByte(part, '['); i >= 0 {
+			key = part[:i]
+		}
+		if key == "" {
+			return nil, fmt.Errorf("invalid path %q: empty key", spec)
+		}
+		s.segments = append(s.segments, pathSegment{key: key, wildcard: key == "*"})
+		for rest := part[len(key):]; rest != ""; {
+			end := strings.IndexByte(rest, ']')
+			if rest[0] != '[' || end < 0 {
+				return nil, fmt.Errorf("invalid path %q: malformed index in %s", spec, part)
+			}
+			seg := pathSegment{isIndex: true}
+			if idx := rest[1:end]; idx == "*" {
+				seg.wildcard = true
+			} else {
+				n, err := strconv.Atoi(idx)
+				if err != nil {
+					return nil, fmt.Errorf("invalid path %q: index %q is not an integer", spec, idx)
+				}
+				seg.index = n
+			}
+			s.segments = append(s.segments, seg)
+			rest = rest[end+1:]
+		}
+	}
+	for _, seg := range s.segments {
+		s.wildcard = s.wildcard || seg.wildcard
+	}
+	if s.name == "" {
+		if s.wildcard {
+			s.name = "{{path}}"
+		} else {
+			s.name = spec
+		}
+	} else if s.wildcard && !strings.Contains(s.name, "{{key}}") && !strings.Contains(s.name, "{{path}}") {
+		return nil, fmt.Errorf("name %s of wildcard path %s must contain {{key}} or {{path}}", s.name, spec)
+	}
+	return s, nil
+}
+
+func asArray(v interface{}) ([]interface{}, bool) {
+	switch vt := v.(type) {
+	case []interface{}:
+		return vt, true
+	case primitive.A:
+		return vt, true
+	default:
+		return nil, false
+	}
+}
+
+func isContainer(v interface{}) bool {
+	if _, ok := v.(map[string]interface{}); ok {
+		return true
+	}
+	_, ok := asArray(v)
+	return ok
+}
+
+// resolve returns the values matched in doc, in document order for arrays
+// and key order for maps
+func (s *pathSelector) resolve(doc map[string]interface{}) []pathMatch {
+	var matches []pathMatch
+	var walk func(cur interface{}, segs []pathSegment, path, key string)
+	walk = func(cur interface{}, segs []pathSegment, path, key string) {
+		if len(segs) == 0 {
+			matches = append(matches, pathMatch{path: path, key: key, value: cur})
+			return
+		}
+		seg, rest := segs[0], segs[1:]
+		if seg.isIndex {
+			arr, ok := asArray(cur)
+			if !ok {
+				return
+			}
+			if seg.wildcard {
+				for i, v := range arr {
+					walk(v, rest, fmt.Sprintf("%s[%d]", path, i), strconv.Itoa(i))
+				}
+				return
+			}
+			i := seg.index
+			if i < 0 {
+				i += len(arr)
+			}
+			if i >= 0 && i < len(arr) {
+				walk(arr[i], rest, fmt.Sprintf("%s[%d]", path, i), key)
+			}
+			return
+		}
+		m, ok := cur.(map[string]interface{})
+		if !ok {
+			return
+		}
+		join := func(k string) string {
+			if path == "" {
+				return k
+			}
+			return path + "." + k
+		}
+		if seg.wildcard {
+			keys := make([]string, 0, len(m))
+			for k := range m {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			for _, k := range keys {
+				walk(m[k], rest, join(k), k)
+			}
+			return
+		}
+		if v, ok := m[seg.key]; ok {
+			walk(v, rest, join(seg.key), key)
+		}
+	}
+	walk(doc, s.segments, "", "")
+	return matches
+}
+
+func (s *pathSelector) outputName(match pathMatch) string {
+	return strings.NewReplacer("{{key}}", match.key, "{{path}}", match.path).Replace(s.name)
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func selectorDoc() map[string]interface{} {
+	return map[string]interface{}{
+		"legs": []interface{}{
+			map[string]interface{}{"price": 1.5, "qty": 2},
+			map[string]interface{}{"price": 2.5, "qty": 3},
+			map[string]interface{}{"price": 3.5, "qty": 4},
+		},
+		"matrix": primitive.A{primitive.A{1, 2}, primitive.A{3, 4}},
+		"meta": map[string]interface{}{
+			"venue": "tomox",
+			"fee":   0.1,
+		},
+		"pair": "TOMO/USDT",
+	}
+}
+
+func TestSelectorResolve(t *testing.T) {
+	tests := []struct {
+		spec, name string
+		want       map[string]interface{}
+	}{
+		{"legs[0].price", "", map[string]interface{}{"legs[0].price": 1.5}},
+		{"legs[-1].qty", "last_qty", map[string]interface{}{"last_qty": 4}},
+		{"legs[-3].qty", "first_qty", map[string]interface{}{"first_qty": 2}},
+		{"legs[-4].qty", "none", map[string]interface{}{}},
+		{"legs[3].qty", "none", map[string]interface{}{}},
+		{"legs[*].price", "price_{{key}}", map[string]interface{}{
+			"price_0": 1.5, "price_1": 2.5, "price_2": 3.5,
+		}},
+		{"legs[*].price", "", map[string]interface{}{
+			"legs[0].price": 1.5, "legs[1].price": 2.5, "legs[2].price": 3.5,
+		}},
+		{"meta.*", "meta_{{key}}", map[string]interface{}{"meta_venue": "tomox", "meta_fee": 0.1}},
+		{"matrix[1][-1]", "corner", map[string]interface{}{"corner": 4}},
+		{"matrix[*][0]", "col_{{key}}", map[string]interface{}{"col_0": 1, "col_1": 3}},
+		{"pair[0]", "none", map[string]interface{}{}},
+		{"meta[*]", "none_{{key}}", map[string]interface{}{}},
+		{"missing.*", "none_{{key}}", map[string]interface{}{}},
+	}
+	for _, test := range tests {
+		s, err := parseSelector(test.spec, test.name)
+		if err != nil {
+			t.Errorf("parseSelector(%q, %q): %s", test.spec, test.name, err)
+			continue
+		}
+		got := make(map[string]interface{})
+		for _, match := range s.resolve(selectorDoc()) {
+			got[s.outputName(match)] = match.value
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s:%s resolved %v, want %v", test.spec, test.name, got, test.want)
+		}
+	}
+}
+
+func TestSelectorResolveOrder(t *testing.T) {
+	s, err := parseSelector("meta.*", "{{path}}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var paths []string
+	for _, match := range s.resolve(selectorDoc()) {
+		paths = append(paths, match.path)
+	}
+	if want := []string{"meta.fee", "meta.venue"}; !reflect.DeepEqual(paths, want) {
+		t.Errorf("expected map keys in order %v, got %v", want, paths)
+	}
+}
+
+func TestParseSelectorErrors(t *testing.T) {
+	tests := []struct {
+		spec, name string
+	}{
+		{"legs[", ""},
+		{"legs[0", ""},
+		{"legs[a]", ""},
+		{"legs[0]x", ""},
+		{"legs..price", ""},
+		{".price", ""},
+		{"[0]", ""},
+		{"legs[*].price", "price"},
+		{"meta.*", "meta"},
+	}
+	for _, test := range tests {
+		if _, err := parseSelector(test.spec, test.name); err == nil {
+			t.Errorf("parseSelector(%q, %q) succeeded, want an error", test.spec, test.name)
+		}
+	}
+}
+
+func TestLookupPath(t *testing.T) {
+	doc := selectorDoc()
+	doc["flat.key"] = "flat"
+	tests := []struct {
+		path  string
+		want  interface{}
+		found bool
+	}{
+		{"pair", "TOMO/USDT", true},
+		{"flat.key", "flat", true},
+		{"meta.venue", "tomox", true},
+		{"meta.venue.name", nil, false},
+		{"legs[1].price", 2.5, true},
+		{"legs[*].qty", 2, true},
+		{"legs[9].qty", nil, false},
+		{"missing", nil, false},
+		{"missing.venue", nil, false},
+		{"pair.venue", nil, false},
+	}
+	for _, test := range tests {
+		got, found := lookupPath(doc, test.path)
+		if found != test.found || !reflect.DeepEqual(got, test.want) {
+			t.Errorf("lookupPath(%q) = %v, %t, want %v, %t", test.path, got, found, test.want, test.found)
+		}
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	client "github.com/influxdata/influxdb1-client/v2"
+	"github.com/rwynn/gtm"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	influxSinkName   = "influxdb"
+	influxV2SinkName = "influxdb2"
+)
+
+// Batch is a set of points bound for the same database and retention policy
+type Batch struct {
+	Database        string
+	RetentionPolicy string
+	Precision       string
+	Points          []*client.Point
+	ops             []*gtm.Op // the op which produced each point
+	// remembered saves the points of the documents once they are written
+	remembered []mongo.WriteModel
+	// measure is the key of the measurement which produced the points
+	measure string
+}
+
+func (b *Batch) add(pt *client.Point, op *gtm.Op) {
+	b.Points = append(b.Points, pt)
+	b.ops = append(b.ops, op)
+}
+
+// subset returns a batch with the same target holding the points at indexes
+func (b *Batch) subset(indexes []int) *Batch {
+	sub := &Batch{
+		Database:        b.Database,
+		RetentionPolicy: b.RetentionPolicy,
+		Precision:       b.Precision,
+		measure:         b.measure,
+	}
+	for _, i := range indexes {
+		sub.add(b.Points[i], b.ops[i])
+	}
+	return sub
+}
+
+// Sink is the destination of the points produced by the measurement mappings
+type Sink interface {
+	// EnsureDatabase creates the database or bucket if it does not exist
+	EnsureDatabase(db string) error
+	// WriteBatch writes all the points of the batch
+	WriteBatch(b *Batch) error
+	Close() error
+}
+
+// precisionValidator is implemented by sinks which support a subset of the
+// InfluxDB precisions so that measurements can be checked at startup
+type precisionValidator interface {
+	ValidPrecision(precision string) bool
+}
+
+// targetSetter is implemented by sinks which need the database and precision
+// of every measurement before the first write. CheckTargets has no effect on
+// the sink so that a configuration can be validated while the sink is in use.
+type targetSetter interface {
+	CheckTargets(targets []*Batch) error
+	SetTargets(targets []*Batch) error
+}
+
+type sinkFactory func(config *configOptions) (Sink, error)
+
+var sinkFactories = map[string]sinkFactory{
+	influxSinkName:   newInfluxSink,
+	influxV2SinkName: newInfluxV2Sink,
+	stdoutSinkName:   newStdoutSink,
+	fileSinkName:     newFileSink,
+}
+
+func sinkNames() string {
+	var names []string
+	for name := range sinkFactories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// sinkName returns the configured sink or the InfluxDB sink matching the
+// credentials
+func (config *configOptions) sinkName() string {
+	if config.Sink != "" {
+		return config.Sink
+	}
+	if config.InfluxToken != "" {
+		return influxV2SinkName
+	}
+	return influxSinkName
+}
+
+func (config *configOptions) NewSink() (Sink, error) {
+	name := config.sinkName()
+	factory := sinkFactories[name]
+	if factory == nil {
+		return nil, fmt.Errorf("unknown sink %q, expected one of %s", name, sinkNames())
+	}
+	return factory(config)
+}
+
+// influxSink writes to InfluxDB 1.x through the influxdb1-client library
+type influxSink struct {
+	c client.Client
+}
+
+func newInfluxSink(config *configOptions) (Sink, error) {
+	httpConfig := client.HTTPConfig{
+		UserAgent:          fmt.Sprintf("%s v%s", Name, Version),
+		Addr:               config.InfluxURL,
+		Username:           config.InfluxUser,
+		Password:           config.InfluxPassword,
+		InsecureSkipVerify: config.InfluxSkipVerify,
+	}
+	if config.InfluxPemFile != "" {
+		tlsConfig, err := config.InfluxTLS()
+		if err != nil {
+			return nil, err
+		}
+		httpConfig.TLSConfig = tlsConfig
+	}
+	c, err := client.NewHTTPClient(httpConfig)
+	if err != nil {
+		return nil, err
+	}
+	return &influxSink{c: c}, nil
+}
+
+func (s *influxSink) EnsureDatabase(db string) error {
+	q := client.NewQuery(fmt.Sprintf(`CREATE DATABASE "%s"`, db), "", "")
+	if response, err := s.c.Query(q); err != nil {
+		return err
+	} else {
+		return response.Error()
+	}
+}
+
+func (s *influxSink) WriteBatch(b *Batch) error {
+	bp, err := client.NewBatchPoints(client.BatchPointsConfig{
+		Database:        b.Database,
+		RetentionPolicy: b.RetentionPolicy,
+		Precision:       b.Precision,
+	})
+	if err != nil {
+		return err
+	}
+	bp.AddPoints(b.Points)
+	return s.c.Write(bp)
+}
+
+func (s *influxSink) Close() error {
+	return s.c.Close()
+}
+
+func quoteIdent(s string) string {
+	return `"` + strings.Replace(strings.Replace(s, `\`, `\\`, -1), `"`, `\"`, -1) + `"`
+}
+
+func quoteLiteral(s string) string {
+	return `'` + strings.Replace(strings.Replace(s, `\`, `\\`, -1), `'`, `\'`, -1) + `'`
+}
+
+// DeletePoint deletes the series point at the exact time with InfluxQL
+func (s *influxSink) DeletePoint(ref *pointRef) error {
+	where := []string{fmt.Sprintf("time = %d", ref.Time.UnixNano())}
+	for k, v := range ref.Tags {
+		where = append(where, fmt.Sprintf("%s = %s", quoteIdent(k), quoteLiteral(v)))
+	}
+	q := client.NewQuery(fmt.Sprintf("DELETE FROM %s WHERE %s",
+		quoteIdent(ref.Name), strings.Join(where, " AND ")), ref.Database, "")
+	if response, err := s.c.Query(q); err != nil {
+		return err
+	} else {
+		return response.Error()
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	tagIntFormatDefault  = "%d"
+	tagTimeFormatDefault = time.RFC3339Nano
+)
+
+// checkTagFormats validates the tag formats of the measurement at startup
+func (im *InfluxMeasure) checkTagFormats() error {
+	if im.tagIntFormat == "" {
+		im.tagIntFormat = tagIntFormatDefault
+	}
+	if im.tagTimeFormat == "" {
+		im.tagTimeFormat = tagTimeFormatDefault
+	}
+	if s := fmt.Sprintf(im.tagIntFormat, int64(1)); strings.Contains(s, "%!") {
+		return fmt.Errorf("tag-int-format %q is not a valid integer format for namespace %s", im.tagIntFormat, im.ns)
+	}
+	return nil
+}
+
+// setRawTags records the tags which only accept string values. The names
+// may refer to the document key or to the output name of a configured tag.
+func (im *InfluxMeasure) setRawTags(names []string) {
+	im.rawTags = make(map[string]bool)
+	for _, name := range names {
+		if _, ok := im.tags[name]; !ok {
+			for k, out := range im.tags {
+				if out == name {
+					name = k
+					break
+				}
+			}
+			for _, s := range im.tagSelectors {
+				if s.name == name {
+					name = s.spec
+					break
+				}
+			}
+		}
+		im.rawTags[name] = true
+	}
+}
+
+// tagString converts a document value to a tag value. Strings are used as is
+// and the other scalar types are formatted unless the tag k is raw.
+func (im *InfluxMeasure) tagString(k string, v interface{}) (string, bool) {
+	if s, ok := v.(string); ok {
+		return s, true
+	}
+	if im.rawTags[k] {
+		return "", false
+	}
+	switch vt := v.(type) {
+	case int:
+		return fmt.Sprintf(im.tagIntFormat, int64(vt)), true
+	case int8:
+		return fmt.Sprintf(im.tagIntFormat, int64(vt)), true
+	case int16:
+		return fmt.Sprintf(im.tagIntFormat, int64(vt)), true
+	case int32:
+		return fmt.Sprintf(im.tagIntFormat, int64(vt)), true
+	case int64:
+		return fmt.Sprintf(im.tagIntFormat, vt), true
+	case uint:
+		return fmt.Sprintf(im.tagIntFormat, uint64(vt)), true
+	case uint8:
+		return fmt.Sprintf(im.tagIntFormat, uint64(vt)), true
+	case uint16:
+		return fmt.Sprintf(im.tagIntFormat, uint64(vt)), true
+	case uint32:
+		return fmt.Sprintf(im.tagIntFormat, uint64(vt)), true
+	case uint64:
+		return fmt.Sprintf(im.tagIntFormat, vt), true
+	case float32:
+		return strconv.FormatFloat(float64(vt), 'f', -1, 32), true
+	case float64:
+		return strconv.FormatFloat(vt, 'f', -1, 64), true
+	case bool:
+		return strconv.FormatBool(vt), true
+	case primitive.ObjectID:
+		return vt.Hex(), true
+	case primitive.Decimal128:
+		return vt.String(), true
+	case time.Time, primitive.DateTime, primitive.Timestamp:
+		t, _ := toTime(v)
+		return t.Format(im.tagTimeFormat), true
+	default:
+		return "", false
+	}
+}
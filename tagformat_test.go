@@ -0,0 +1,66 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestTagString(t *testing.T) {
+	d, err := primitive.ParseDecimal128("0.125")
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := time.Date(2020, 9, 13, 12, 26, 40, 0, time.UTC)
+	tests := []struct {
+		intFormat  string
+		timeFormat string
+		k          string
+		v          interface{}
+		want       string
+		ok         bool
+	}{
+		{"", "", "pair", "TOMO/USDT", "TOMO/USDT", true},
+		{"", "", "status", "FILLED", "FILLED", true},
+		{"", "", "count", int32(7), "7", true},
+		{"%05d", "", "count", int64(7), "00007", true},
+		{"%x", "", "count", uint64(255), "ff", true},
+		{"%d", "", "count", uint8(3), "3", true},
+		{"", "", "ratio", 0.5, "0.5", true},
+		{"", "", "ratio", float32(0.1), "0.1", true},
+		{"", "", "maker", true, "true", true},
+		{"", "", "owner", primitive.ObjectID{0x5d}, "5d0000000000000000000000", true},
+		{"", "", "amount", d, "0.125", true},
+		{"", "", "at", at, "2020-09-13T12:26:40Z", true},
+		{"", "2006-01-02", "at", primitive.NewDateTimeFromTime(at), "2020-09-13", true},
+		{"", "2006-01-02", "at", primitive.Timestamp{T: uint32(at.Unix())}, "2020-09-13", true},
+		{"", "", "status", int64(1), "", false},
+		{"", "", "legs", []interface{}{"a"}, "", false},
+		{"", "", "meta", map[string]interface{}{"a": 1}, "", false},
+		{"", "", "none", nil, "", false},
+	}
+	for _, test := range tests {
+		im := &InfluxMeasure{
+			ns:            "tomodex.trades",
+			tags:          map[string]string{"status": "state"},
+			tagIntFormat:  test.intFormat,
+			tagTimeFormat: test.timeFormat,
+		}
+		if err := im.checkTagFormats(); err != nil {
+			t.Fatal(err)
+		}
+		im.setRawTags([]string{"state"})
+		got, ok := im.tagString(test.k, test.v)
+		if ok != test.ok || got != test.want {
+			t.Errorf("tagString(%s, %T %v) = %q, %t, want %q, %t", test.k, test.v, test.v, got, ok, test.want, test.ok)
+		}
+	}
+}
+
+func TestCheckTagFormats(t *testing.T) {
+	im := &InfluxMeasure{ns: "tomodex.trades", tagIntFormat: "%s-%d"}
+	if err := im.checkTagFormats(); err == nil {
+		t.Error("expected a tag-int-format with two verbs to be rejected")
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/rwynn/gtm"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// templateEnv is the data of measurement templates
+type templateEnv struct {
+	Tags   map[string]string
+	Fields map[string]interface{}
+	Doc    map[string]interface{}
+	Op     *templateOp
+}
+
+// templateOp describes the op behind a point as .Op in measurement templates
+type templateOp struct {
+	Id         interface{}
+	Namespace  string
+	Database   string
+	Collection string
+	Operation  string
+	Source     string
+	Time       time.Time
+}
+
+// newTemplateOp describes op for a point at pointTime. Direct reads have no
+// oplog time so Time falls back to the point time, i.e. the timefield, or
+// the current time when that is not known either.
+func newTemplateOp(op *gtm.Op, pointTime time.Time) *templateOp {
+	t := TimestampTime(op.Timestamp)
+	if op.Timestamp.T == 0 {
+		if pointTime.Unix() > 0 {
+			t = pointTime.UTC()
+		} else {
+			t = time.Now().UTC()
+		}
+	}
+	return &templateOp{
+		Id:         op.Id,
+		Namespace:  op.Namespace,
+		Database:   op.GetDatabase(),
+		Collection: op.GetCollection(),
+		Operation:  op.Operation,
+		Source:     sourceName(op),
+		Time:       t,
+	}
+}
+
+func templateString(v interface{}) string {
+	switch vt := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return vt
+	case primitive.ObjectID:
+		return vt.Hex()
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+func isEmptyValue(v interface{}) bool {
+	switch vt := v.(type) {
+	case nil:
+		return true
+	case string:
+		return vt == ""
+	case bool:
+		return !vt
+	}
+	if f, ok := toFloat(v); ok {
+		return f == 0
+	}
+	return false
+}
+
+// valueError is returned by template functions given a value they cannot
+// handle, e.g. date on a string. The placeholder values of the sample document
+// used to check templates raise it, which is not a mistake in the template.
+type valueError struct {
+	msg string
+}
+
+func (e *valueError) Error() string {
+	return e.msg
+}
+
+func hexSum(sum []byte) string {
+	return hex.EncodeToString(sum)
+}
+
+// measureFuncs are available in measurement name templates. The value
+// operated on comes last so that they can be used in pipelines, e.g.
+// {{ .Doc.pair | replace "/" "_" | lower }}
+var measureFuncs = template.FuncMap{
+	"lower": func(s interface{}) string {
+		return strings.ToLower(templateString(s))
+	},
+	"upper": func(s interface{}) string {
+		return strings.ToUpper(templateString(s))
+	},
+	"replace": func(old, new string, s interface{}) string {
+		return strings.Replace(templateString(s), old, new, -1)
+	},
+	"trimPrefix": func(prefix string, s interface{}) string {
+		return strings.TrimPrefix(templateString(s), prefix)
+	},
+	"trimSuffix": func(suffix string, s interface{}) string {
+		return strings.TrimSuffix(templateString(s), suffix)
+	},
+	"default": func(def, v interface{}) interface{} {
+		if isEmptyValue(v) {
+			return def
+		}
+		return v
+	},
+	"date": func(layout string, v interface{}) (string, error) {
+		t, ok := toTime(v)
+		if !ok {
+			return "", &valueError{msg: fmt.Sprintf("date expects a time but got %T", v)}
+		}
+		return t.Format(layout), nil
+	},
+	"truncate": func(n int, s interface{}) string {
+		str := templateString(s)
+		if n < 0 {
+			return str
+		}
+		// cut on a character boundary so that the name stays valid UTF-8
+		for i := range str {
+			if n == 0 {
+				return str[:i]
+			}
+			n--
+		}
+		return str
+	},
+	"hash": func(s interface{}) string {
+		h := fnv.New32a()
+		h.Write([]byte(templateString(s)))
+		return hexSum(h.Sum(nil))
+	},
+	"md5": func(s interface{}) string {
+		sum := md5.Sum([]byte(templateString(s)))
+		return hexSum(sum[:])
+	},
+	"sha1": func(s interface{}) string {
+		sum := sha1.Sum([]byte(templateString(s)))
+		return hexSum(sum[:])
+	},
+	"sha256": func(s interface{}) string {
+		sum := sha256.Sum256([]byte(templateString(s)))
+		return hexSum(sum[:])
+	},
+}
+
+// checkMeasureTemplate renders the measurement name template against a
+// sample document holding every configured key so that mistakes surface at
+// startup rather than on the first document. Functions which reject the
+// placeholder values of the sample are not treated as mistakes.
+func (im *InfluxMeasure) checkMeasureTemplate() error {
+	if im.measureTpl == nil {
+		return nil
+	}
+	now := time.Now().UTC()
+	doc := map[string]interface{}{"_id": primitive.NewObjectID()}
+	tags := make(map[string]string)
+	fields := make(map[string]interface{})
+	for k, name := range im.tags {
+		setPath(doc, k, "sample")
+		tags[name] = "sample"
+	}
+	for k, name := range im.fields {
+		setPath(doc, k, "sample")
+		fields[name] = "sample"
+	}
+	for _, cv := range im.computedTags {
+		tags[cv.name] = "sample"
+	}
+	for _, cv := range im.computedFields {
+		fields[cv.name] = "sample"
+	}
+	for _, k := range im.required {
+		if !isSelector(k) {
+			if _, found := lookupPath(doc, k); !found {
+				setPath(doc, k, "sample")
+			}
+		}
+	}
+	if im.timefield != "" && !isSelector(im.timefield) {
+		setPath(doc, im.timefield, now)
+	}
+	m := &InfluxDataMap{
+		op: &gtm.Op{
+			Id:        doc["_id"],
+			Namespace: im.ns,
+			Operation: "i",
+			Source:    gtm.OplogQuerySource,
+			Timestamp: primitive.Timestamp{T: uint32(now.Unix())},
+			Data:      doc,
+		},
+		measure: im,
+		nameTpl: im.measureTpl,
+	}
+	var ve *valueError
+	if err := m.resolveName(tags, fields, doc); err != nil && !errors.As(err, &ve) {
+		return fmt.Errorf("measurement template for namespace %s failed on a sample document: %s", im.ns, err)
+	}
+	return nil
+}
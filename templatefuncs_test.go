@@ -0,0 +1,56 @@
+package main
+
+import (
+	"testing"
+	"text/template"
+)
+
+func TestTruncate(t *testing.T) {
+	truncate := measureFuncs["truncate"].(func(int, interface{}) string)
+	tests := []struct {
+		n    int
+		s    interface{}
+		want string
+	}{
+		{3, "trades", "tra"},
+		{10, "trades", "trades"},
+		{0, "trades", ""},
+		{-1, "trades", "trades"},
+		{2, "héllo", "hé"},
+		{1, "日本語", "日"},
+		{3, 12345, "123"},
+	}
+	for _, test := range tests {
+		if got := truncate(test.n, test.s); got != test.want {
+			t.Errorf("truncate(%d, %v) = %q, want %q", test.n, test.s, got, test.want)
+		}
+	}
+}
+
+func TestCheckMeasureTemplate(t *testing.T) {
+	tests := []struct {
+		measure string
+		valid   bool
+	}{
+		{`{{ .Doc.pair | lower }}_{{ .Op.Time | date "2006_01" }}`, true},
+		// the sample holds a string where a date is expected
+		{`{{ .Doc.pair | date "2006" }}`, true},
+		{`{{ index .Doc.legs 10 }}`, false},
+		{`{{ .Doc.pair | printf "%s" | date }}`, false},
+	}
+	for _, test := range tests {
+		tpl, err := template.New("tomodex.trades").Funcs(measureFuncs).Parse(test.measure)
+		if err != nil {
+			t.Fatal(err)
+		}
+		im := &InfluxMeasure{
+			ns:         "tomodex.trades",
+			measureTpl: tpl,
+			tags:       map[string]string{"pair": "pair"},
+			fields:     map[string]string{"legs": "legs"},
+		}
+		if err := im.checkMeasureTemplate(); (err == nil) != test.valid {
+			t.Errorf("checkMeasureTemplate(%s) returned %v", test.measure, err)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// setTimeFormat validates the timefield-format and timezone of the measurement.
+// The format is one of unix, unix_ms, unix_us, unix_ns, rfc3339 or a Go time
+// layout. Strings without a zone are read in the timezone, UTC by default.
+func (im *InfluxMeasure) setTimeFormat(format, timezone string) error {
+	im.timeFormat = format
+	im.timeLocation = time.UTC
+	if timezone != "" {
+		loc, err := time.LoadLocation(timezone)
+		if err != nil {
+			return fmt.Errorf("invalid timezone %q for namespace %s: %s", timezone, im.ns, err)
+		}
+		im.timeLocation = loc
+	}
+	switch strings.ToLower(format) {
+	case "", "unix", "unix_ms", "unix_us", "unix_ns":
+		im.timeFormat = strings.ToLower(format)
+	case "rfc3339":
+		im.timeFormat = time.RFC3339Nano
+	default:
+		if s := time.Date(2001, 2, 3, 4, 5, 6, 0, time.UTC).Format(format); s == format {
+			return fmt.Errorf("timefield-format %q for namespace %s is not a time layout", format, im.ns)
+		}
+	}
+	return nil
+}
+
+// epochNanos converts i of unit to nanoseconds, which only span the years
+// 1678 to 2262
+func epochNanos(i int64, unit time.Duration) (int64, error) {
+	if i > math.MaxInt64/int64(unit) || i < math.MinInt64/int64(unit) {
+		return 0, fmt.Errorf("value %d is out of the range of times", i)
+	}
+	return i * int64(unit), nil
+}
+
+// epochTime reads v as a count of unit since the Unix epoch
+func epochTime(v interface{}, unit time.Duration) (time.Time, error) {
+	if i, ok := toInt(v); ok {
+		ns, err := epochNanos(i, unit)
+		if err != nil {
+			return time.Time{}, err
+		}
+		return time.Unix(0, ns).UTC(), nil
+	}
+	var f float64
+	var err error
+	switch vt := v.(type) {
+	case float32:
+		f = float64(vt)
+	case float64:
+		f = vt
+	case primitive.Decimal128:
+		f, err = parseDecimal(vt)
+	case string:
+		if i, err := strconv.ParseInt(strings.TrimSpace(vt), 10, 64); err == nil {
+			ns, err := epochNanos(i, unit)
+			if err != nil {
+				return time.Time{}, err
+			}
+			return time.Unix(0, ns).UTC(), nil
+		}
+		f, err = strconv.ParseFloat(strings.TrimSpace(vt), 64)
+	default:
+		return time.Time{}, fmt.Errorf("had type %T, but expected a number", v)
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return time.Time{}, fmt.Errorf("value %v is not a valid time", v)
+	}
+	whole := math.Floor(f)
+	if whole >= math.MaxInt64/float64(unit) || whole < math.MinInt64/float64(unit) {
+		return time.Time{}, fmt.Errorf("value %v is out of the range of times", v)
+	}
+	ns, err := epochNanos(int64(whole), unit)
+	if err != nil {
+		return time.Time{}, err
+	}
+	frac := math.Round((f - whole) * float64(unit))
+	if ns > math.MaxInt64-int64(frac) {
+		return time.Time{}, fmt.Errorf("value %v is out of the range of times", v)
+	}
+	return time.Unix(0, ns+int64(frac)).UTC(), nil
+}
+
+// pointTime converts the value of the time field to the point time. BSON
+// times are always accepted, other values only with a timefield-format.
+func (im *InfluxMeasure) pointTime(v interface{}) (time.Time, error) {
+	if t, ok := toTime(v); ok {
+		return t, nil
+	}
+	switch im.timeFormat {
+	case "":
+		return time.Time{}, fmt.Errorf("had type %T, but expected %T", v, time.Time{})
+	case "unix", "unix_ms", "unix_us", "unix_ns":
+		return epochTime(v, epochUnit(im.timeFormat))
+	default:
+		s, ok := v.(string)
+		if !ok {
+			return time.Time{}, fmt.Errorf("had type %T, but expected a string in the form %s", v, im.timeFormat)
+		}
+		t, err := time.ParseInLocation(im.timeFormat, strings.TrimSpace(s), im.timeLocation)
+		if err != nil {
+			return time.Time{}, err
+		}
+		return t.UTC(), nil
+	}
+}
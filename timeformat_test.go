@@ -0,0 +1,96 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestEpochTime(t *testing.T) {
+	tests := []struct {
+		v    interface{}
+		unit time.Duration
+		want time.Time
+		ok   bool
+	}{
+		{int64(1600000000), time.Second, time.Unix(1600000000, 0), true},
+		{int32(-86400), time.Second, time.Unix(-86400, 0), true},
+		{int64(1600000000123), time.Millisecond, time.Unix(1600000000, 123000000), true},
+		{"1600000000123456", time.Microsecond, time.Unix(1600000000, 123456000), true},
+		{" 1600000000 ", time.Second, time.Unix(1600000000, 0), true},
+		{1600000000.5, time.Second, time.Unix(1600000000, 500000000), true},
+		{-0.5, time.Second, time.Unix(-1, 500000000), true},
+		{"1600000000.25", time.Second, time.Unix(1600000000, 250000000), true},
+		{int64(math.MaxInt64), time.Nanosecond, time.Unix(0, math.MaxInt64), true},
+		{int64(math.MaxInt64), time.Second, time.Time{}, false},
+		{int64(math.MinInt64 / 1000), time.Millisecond, time.Time{}, false},
+		{"99999999999999", time.Millisecond, time.Time{}, false},
+		{1e19, time.Nanosecond, time.Time{}, false},
+		{1e12, time.Second, time.Time{}, false},
+		{math.NaN(), time.Second, time.Time{}, false},
+		{math.Inf(1), time.Second, time.Time{}, false},
+		{"soon", time.Second, time.Time{}, false},
+		{true, time.Second, time.Time{}, false},
+	}
+	for _, test := range tests {
+		got, err := epochTime(test.v, test.unit)
+		if (err == nil) != test.ok {
+			t.Errorf("epochTime(%v, %s) returned error %v", test.v, test.unit, err)
+			continue
+		}
+		if test.ok && !got.Equal(test.want) {
+			t.Errorf("epochTime(%v, %s) = %s, want %s", test.v, test.unit, got, test.want)
+		}
+	}
+}
+
+func TestPointTime(t *testing.T) {
+	date := time.Date(2020, 9, 13, 12, 26, 40, 0, time.UTC)
+	tests := []struct {
+		format   string
+		timezone string
+		v        interface{}
+		want     time.Time
+		ok       bool
+	}{
+		{"", "", primitive.NewDateTimeFromTime(date), date, true},
+		{"", "", date, date, true},
+		{"", "", date.Unix(), time.Time{}, false},
+		{"unix", "", date.Unix(), date, true},
+		{"UNIX_MS", "", date.Unix() * 1000, date, true},
+		{"unix_ns", "", date.UnixNano(), date, true},
+		{"unix_ms", "", date, date, true},
+		{"unix", "", int64(math.MaxInt64), time.Time{}, false},
+		{"rfc3339", "", "2020-09-13T20:26:40+08:00", date, true},
+		{"rfc3339", "", "2020-09-13", time.Time{}, false},
+		{"2006-01-02 15:04:05", "", "2020-09-13 12:26:40", date, true},
+		{"2006-01-02 15:04:05", "Asia/Singapore", "2020-09-13 20:26:40", date, true},
+		{"2006-01-02 15:04:05", "", 1600000000, time.Time{}, false},
+	}
+	for _, test := range tests {
+		im := &InfluxMeasure{ns: "tomodex.trades"}
+		if err := im.setTimeFormat(test.format, test.timezone); err != nil {
+			t.Fatal(err)
+		}
+		got, err := im.pointTime(test.v)
+		if (err == nil) != test.ok {
+			t.Errorf("pointTime(%v) with format %q returned error %v", test.v, test.format, err)
+			continue
+		}
+		if test.ok && !got.Equal(test.want) {
+			t.Errorf("pointTime(%v) with format %q = %s, want %s", test.v, test.format, got, test.want)
+		}
+	}
+}
+
+func TestSetTimeFormat(t *testing.T) {
+	im := &InfluxMeasure{ns: "tomodex.trades"}
+	if err := im.setTimeFormat("yesterday", ""); err == nil {
+		t.Error("expected a format without layout elements to be rejected")
+	}
+	if err := im.setTimeFormat("", "Nowhere/Town"); err == nil {
+		t.Error("expected an unknown timezone to be rejected")
+	}
+}